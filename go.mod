@@ -4,8 +4,13 @@ go 1.14
 
 require (
 	github.com/erkkah/letarette v0.1.1
+	github.com/jackc/pgconn v1.7.0
+	github.com/jackc/pgtype v1.5.0
 	github.com/jackc/pgx/v4 v4.9.0
 	github.com/lib/pq v1.8.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.4
+	github.com/xitongsys/parquet-go v1.5.4
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
 )
 
 replace github.com/jackc/pgtype => github.com/erkkah/pgtype v1.5.1-0.20201008073842-d166e5f64f18
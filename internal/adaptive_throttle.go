@@ -0,0 +1,149 @@
+//go:build !nothrottle
+// +build !nothrottle
+
+package sslr
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/logger"
+	"github.com/jackc/pgx/v4"
+)
+
+// sourceLoad holds a sample of source database health signals
+type sourceLoad struct {
+	activeBackends uint32
+	replicationLag time.Duration
+	probeLatency   time.Duration
+}
+
+// startAdaptiveThrottle starts sampling source database load on a separate connection,
+// adjusting the throttle level of the job's throttle budget.
+// The returned function stops sampling.
+func (job *Job) startAdaptiveThrottle(ctx context.Context) (func(), error) {
+	settings := job.cfg.AdaptiveThrottle
+	if !settings.Enabled {
+		return func() {}, nil
+	}
+
+	conn, err := pgx.Connect(ctx, job.cfg.SourceConnection)
+	if err != nil {
+		return nil, err
+	}
+
+	budget := job.throttleBudget
+	minLevel := math.Max(1, math.Min(settings.MinThrottlePercentage, budget.maxLevel*100)) / 100
+	logger.Info.Printf("Adapting throttle to source load, between %.2f%% and %.2f%%", minLevel*100, budget.maxLevel*100)
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Duration(settings.SampleIntervalSeconds * float64(time.Second)))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			load, err := sampleSourceLoad(ctx, conn, settings.ProbeQuery)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Warning.Printf("Failed to sample source load: %v", err)
+				}
+				continue
+			}
+			logger.Debug.Printf("Source load: %v active backends, %v replication lag, %v probe latency",
+				load.activeBackends, load.replicationLag, load.probeLatency)
+
+			budget.adapt(settings.loadLevel(load), minLevel)
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		conn.Close(context.Background())
+	}, nil
+}
+
+func sampleSourceLoad(ctx context.Context, conn *pgx.Conn, probeQuery string) (sourceLoad, error) {
+	var load sourceLoad
+
+	row := conn.QueryRow(ctx, `--sql
+	select
+		count(*)
+	from
+		pg_stat_activity
+	where
+		state = 'active'
+		and pid <> pg_backend_pid()
+	;`)
+	err := row.Scan(&load.activeBackends)
+	if err != nil {
+		return load, err
+	}
+
+	var lagSeconds float64
+	row = conn.QueryRow(ctx, `--sql
+	select
+		coalesce(max(extract(epoch from replay_lag)), 0)::float8
+	from
+		pg_stat_replication
+	;`)
+	err = row.Scan(&lagSeconds)
+	if err != nil {
+		return load, err
+	}
+	load.replicationLag = time.Duration(lagSeconds * float64(time.Second))
+
+	probeStart := time.Now()
+	_, err = conn.Exec(ctx, probeQuery)
+	if err != nil {
+		return load, err
+	}
+	load.probeLatency = time.Since(probeStart)
+
+	return load, nil
+}
+
+// loadLevel returns the highest load signal relative to its configured threshold,
+// where 1 means at the threshold. Signals without thresholds are ignored.
+func (settings AdaptiveThrottleSettings) loadLevel(load sourceLoad) float64 {
+	level := 0.0
+	if settings.MaxActiveBackends > 0 {
+		level = math.Max(level, float64(load.activeBackends)/float64(settings.MaxActiveBackends))
+	}
+	if settings.MaxReplicationLagSeconds > 0 {
+		level = math.Max(level, load.replicationLag.Seconds()/settings.MaxReplicationLagSeconds)
+	}
+	if settings.MaxProbeLatencyMs > 0 {
+		level = math.Max(level, float64(load.probeLatency.Milliseconds())/settings.MaxProbeLatencyMs)
+	}
+	return level
+}
+
+// adapt backs off by halving the throttle level when the source is overloaded,
+// and speeds up step by step towards the configured level when it is clearly not.
+func (b *throttleBudget) adapt(loadLevel float64, minLevel float64) {
+	b.Lock()
+	defer b.Unlock()
+
+	previous := b.level
+	switch {
+	case loadLevel > 1:
+		b.level = math.Max(minLevel, b.level/2)
+	case loadLevel < 0.75:
+		b.level = math.Min(b.maxLevel, b.level+b.maxLevel/10)
+	}
+
+	if b.level != previous {
+		logger.Info.Printf("Source load at %.0f%% of limits, throttle adjusted to %.2f%%", loadLevel*100, b.level*100)
+	}
+}
@@ -0,0 +1,66 @@
+//go:build !nothrottle
+// +build !nothrottle
+
+package sslr
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLoadLevel(t *testing.T) {
+	settings := AdaptiveThrottleSettings{
+		MaxActiveBackends:        10,
+		MaxReplicationLagSeconds: 2,
+		MaxProbeLatencyMs:        100,
+	}
+
+	tests := []struct {
+		name     string
+		settings AdaptiveThrottleSettings
+		load     sourceLoad
+		expected float64
+	}{
+		{"idle", settings, sourceLoad{}, 0},
+		{"backends at threshold", settings, sourceLoad{activeBackends: 10}, 1},
+		{"highest signal wins", settings, sourceLoad{activeBackends: 5, replicationLag: 3 * time.Second, probeLatency: 50 * time.Millisecond}, 1.5},
+		{"probe latency", settings, sourceLoad{probeLatency: 200 * time.Millisecond}, 2},
+		{"no thresholds", AdaptiveThrottleSettings{}, sourceLoad{activeBackends: 100, replicationLag: time.Hour}, 0},
+		{"only lag threshold", AdaptiveThrottleSettings{MaxReplicationLagSeconds: 4}, sourceLoad{activeBackends: 100, replicationLag: time.Second}, 0.25},
+	}
+
+	for _, test := range tests {
+		level := test.settings.loadLevel(test.load)
+		if math.Abs(level-test.expected) > 1e-9 {
+			t.Errorf("%s: load level = %v, expected %v", test.name, level, test.expected)
+		}
+	}
+}
+
+func TestAdapt(t *testing.T) {
+	tests := []struct {
+		name      string
+		level     float64
+		loadLevel float64
+		expected  float64
+	}{
+		{"overloaded backs off", 0.8, 1.5, 0.4},
+		{"back off stops at min", 0.15, 2, 0.1},
+		{"already at min", 0.1, 2, 0.1},
+		{"at threshold stays", 0.4, 1, 0.4},
+		{"between thresholds stays", 0.4, 0.8, 0.4},
+		{"at low threshold stays", 0.4, 0.75, 0.4},
+		{"idle speeds up", 0.4, 0.5, 0.48},
+		{"speed up stops at max", 0.78, 0, 0.8},
+		{"already at max", 0.8, 0, 0.8},
+	}
+
+	for _, test := range tests {
+		budget := &throttleBudget{level: test.level, maxLevel: 0.8}
+		budget.adapt(test.loadLevel, 0.1)
+		if math.Abs(budget.level-test.expected) > 1e-9 {
+			t.Errorf("%s: level = %v, expected %v", test.name, budget.level, test.expected)
+		}
+	}
+}
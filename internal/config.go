@@ -11,24 +11,121 @@ import (
 
 // Config is the main configuration for SSLR
 type Config struct {
-	SourceConnection     string   `json:"source"`
-	TargetConnection     string   `json:"target"`
-	SourceTables         []string `json:"tables"`
-	FilteredSourceTables map[string]struct {
-		Where  string   `json:"where"`
-		Wheres []string `json:"wheres"`
-		Uses   []string `json:"uses"`
-	} `json:"filteredTables"`
-	UpdateChunkSize      uint32        `json:"updateChunkSize"`
-	DeleteChunkSize      uint32        `json:"deleteChunkSize"`
-	MinDeleteChunkSize   uint32        `json:"minDeleteChunkSize"`
-	ThrottlePercentage   float64       `json:"throttlePercentage"`
-	StateTableName       string        `json:"stateTable"`
-	SyncUpdates          bool          `json:"syncUpdates"`
-	SyncDeletes          bool          `json:"syncDeletes"`
-	ResyncOnSchemaChange bool          `json:"resyncOnSchemaChange"`
-	FullCopyThreshold    float64       `json:"fullCopyThreshold"`
-	WaitBetweenJobs      time.Duration `json:"waitBetweenJobs"`
+	SourceConnection     string                           `json:"source"`
+	Sources              []ConnectionSettings             `json:"sources"`
+	SourceColumn         string                           `json:"sourceColumn"`
+	TargetConnection     string                           `json:"target"`
+	Targets              []ConnectionSettings             `json:"targets"`
+	SourceTables         []string                         `json:"tables"`
+	FilteredSourceTables map[string]FilteredTableSettings `json:"filteredTables"`
+	TableSettings        map[string]TableSettings         `json:"tableSettings"`
+	UpdateChunkSize      uint32                           `json:"updateChunkSize"`
+	DeleteChunkSize      uint32                           `json:"deleteChunkSize"`
+	MinDeleteChunkSize   uint32                           `json:"minDeleteChunkSize"`
+	CopyChunkSize        uint32                           `json:"copyChunkSize"`
+	ThrottlePercentage   float64                          `json:"throttlePercentage"`
+	AdaptiveThrottle     AdaptiveThrottleSettings         `json:"adaptiveThrottle"`
+	MaxRowsPerSecond     float64                          `json:"maxRowsPerSecond"`
+	MaxBytesPerSecond    float64                          `json:"maxBytesPerSecond"`
+	StateTableName       string                           `json:"stateTable"`
+	SyncUpdates          bool                             `json:"syncUpdates"`
+	SyncDeletes          bool                             `json:"syncDeletes"`
+	ResyncOnSchemaChange bool                             `json:"resyncOnSchemaChange"`
+	FullCopyThreshold    float64                          `json:"fullCopyThreshold"`
+	ApplyStrategy        string                           `json:"applyStrategy"`
+	VerifyContent        bool                             `json:"verifyContent"`
+	WaitBetweenJobs      time.Duration                    `json:"waitBetweenJobs"`
+	Schedule             ScheduleSettings                 `json:"schedule"`
+	Parallelism          uint32                           `json:"parallelism"`
+	DeleteParallelism    uint32                           `json:"deleteParallelism"`
+	ConsistentSnapshot   bool                             `json:"consistentSnapshot"`
+	AtomicApply          bool                             `json:"atomicApply"`
+	ShadowCopy           bool                             `json:"shadowCopy"`
+	SchemaMapping        map[string]string                `json:"schemaMapping"`
+	ExportFormat         string                           `json:"exportFormat"`
+}
+
+// ConnectionSettings holds a named connection, when syncing from several sources
+// or to several targets
+type ConnectionSettings struct {
+	Name       string `json:"name"`
+	Connection string `json:"connection"`
+}
+
+// TableSettings holds optional per-table settings.
+// Settings for filtered tables are set in the filtered table entry,
+// and for other tables in the "tableSettings" map.
+type TableSettings struct {
+	FullCopyWithoutKey   bool                       `json:"fullCopyWithoutKey"`
+	VerifyExcludeColumns []string                   `json:"verifyExcludeColumns"`
+	Schedule             ScheduleSettings           `json:"schedule"`
+	Columns              []string                   `json:"columns"`
+	ExcludeColumns       []string                   `json:"excludeColumns"`
+	Transforms           map[string]ColumnTransform `json:"transforms"`
+	TargetTable          string                     `json:"targetTable"`
+	TableOverrides
+}
+
+// ColumnTransform describes how to mask or anonymize a column.
+// "Salt" is used by hashing and fake value transforms, "Value" is the
+// redaction replacement and "Unit" the date truncation unit.
+type ColumnTransform struct {
+	Type  string `json:"type"`
+	Salt  string `json:"salt"`
+	Value string `json:"value"`
+	Unit  string `json:"unit"`
+}
+
+// TableOverrides holds per-table overrides of job settings, nil when not overridden
+type TableOverrides struct {
+	UpdateChunkSize    *uint32  `json:"updateChunkSize"`
+	DeleteChunkSize    *uint32  `json:"deleteChunkSize"`
+	MinDeleteChunkSize *uint32  `json:"minDeleteChunkSize"`
+	CopyChunkSize      *uint32  `json:"copyChunkSize"`
+	ThrottlePercentage *float64 `json:"throttlePercentage"`
+	SyncUpdates        *bool    `json:"syncUpdates"`
+	SyncDeletes        *bool    `json:"syncDeletes"`
+	FullCopyThreshold  *float64 `json:"fullCopyThreshold"`
+	ApplyStrategy      *string  `json:"applyStrategy"`
+}
+
+// Apply strategies for updated rows
+const (
+	// Delete and re-insert all updated rows
+	applyReplace = "replace"
+	// Merge updated rows from a staging table, skipping unchanged rows
+	applyUpsert = "upsert"
+)
+
+// ScheduleSettings controls when syncing is performed.
+// Time windows are either daily, like "01:00-05:00" in local time,
+// or absolute, like "2020-10-20T01:00:00Z/2020-10-20T03:00:00Z".
+type ScheduleSettings struct {
+	Cron          string   `json:"cron"`
+	Windows       []string `json:"windows"`
+	UpdateWindows []string `json:"updateWindows"`
+	DeleteWindows []string `json:"deleteWindows"`
+	Blackouts     []string `json:"blackouts"`
+}
+
+// AdaptiveThrottleSettings configures adjusting the throttle level based on
+// source database load. Thresholds set to zero are not used.
+type AdaptiveThrottleSettings struct {
+	Enabled                  bool    `json:"enabled"`
+	SampleIntervalSeconds    float64 `json:"sampleIntervalSeconds"`
+	MinThrottlePercentage    float64 `json:"minThrottlePercentage"`
+	MaxActiveBackends        uint32  `json:"maxActiveBackends"`
+	MaxReplicationLagSeconds float64 `json:"maxReplicationLagSeconds"`
+	ProbeQuery               string  `json:"probeQuery"`
+	MaxProbeLatencyMs        float64 `json:"maxProbeLatencyMs"`
+}
+
+// FilteredTableSettings holds settings for a filtered table
+type FilteredTableSettings struct {
+	Where  string   `json:"where"`
+	Wheres []string `json:"wheres"`
+	Uses   []string `json:"uses"`
+	TableSettings
 }
 
 // LoadConfig reads a JSON - formatted config file into a Config.
@@ -36,16 +133,31 @@ type Config struct {
 func LoadConfig(fileName string) (Config, error) {
 	// Config with default values
 	config := Config{
-		UpdateChunkSize:      1000,
-		ThrottlePercentage:   80,
+		SourceColumn:       "sslr_source",
+		UpdateChunkSize:    1000,
+		ThrottlePercentage: 80,
+		AdaptiveThrottle: AdaptiveThrottleSettings{
+			SampleIntervalSeconds: 5,
+			MinThrottlePercentage: 5,
+			ProbeQuery:            "select 1",
+		},
 		DeleteChunkSize:      1000,
 		MinDeleteChunkSize:   100,
+		CopyChunkSize:        10000,
 		StateTableName:       "__sslr_state",
 		SyncUpdates:          true,
 		SyncDeletes:          true,
 		ResyncOnSchemaChange: false,
 		FullCopyThreshold:    0.5,
+		ApplyStrategy:        applyReplace,
+		VerifyContent:        false,
 		WaitBetweenJobs:      time.Second * 5,
+		Parallelism:          1,
+		DeleteParallelism:    1,
+		ConsistentSnapshot:   false,
+		AtomicApply:          false,
+		ShadowCopy:           false,
+		ExportFormat:         exportCSV,
 	}
 	jsonData, err := ioutil.ReadFile(fileName)
 	if err != nil {
@@ -65,9 +177,74 @@ func LoadConfig(fileName string) (Config, error) {
 		return config, err
 	}
 
+	err = config.validateTableSettings()
+	if err != nil {
+		return config, err
+	}
+
+	err = config.AdaptiveThrottle.validate()
+	if err != nil {
+		return config, err
+	}
+
+	err = config.validateSchedules()
+	if err != nil {
+		return config, err
+	}
+
+	err = config.validateTableOverrides()
+	if err != nil {
+		return config, err
+	}
+
+	err = config.validateTargetTables()
+	if err != nil {
+		return config, err
+	}
+
+	err = config.validateSources()
+	if err != nil {
+		return config, err
+	}
+
+	err = config.validateTargets()
+	if err != nil {
+		return config, err
+	}
+
+	err = config.validateLocalTarget()
+	if err != nil {
+		return config, err
+	}
+
+	err = config.validateAtomicApply()
+	if err != nil {
+		return config, err
+	}
+
 	return config, nil
 }
 
+// validateAtomicApply rejects settings that do not work with a single target
+// transaction, or would keep it open for a long time.
+func (cfg Config) validateAtomicApply() error {
+	if !cfg.AtomicApply {
+		return nil
+	}
+	if cfg.Parallelism > 1 || cfg.DeleteParallelism > 1 {
+		return fmt.Errorf("'atomicApply' cannot be combined with parallel syncing")
+	}
+	if len(cfg.Schedule.Blackouts) > 0 {
+		return fmt.Errorf("'atomicApply' cannot be combined with blackouts")
+	}
+	for _, table := range cfg.allTables() {
+		if len(cfg.tableSettings(table).Schedule.Blackouts) > 0 {
+			return fmt.Errorf("'atomicApply' cannot be combined with blackouts, set for table %q", table)
+		}
+	}
+	return nil
+}
+
 func validateSource(jsonData []byte) error {
 
 	var parsed map[string]interface{}
@@ -76,7 +253,8 @@ func validateSource(jsonData []byte) error {
 		return err
 	}
 
-	validField := func(field string, validType reflect.Type) bool {
+	var validField func(field string, validType reflect.Type) bool
+	validField = func(field string, validType reflect.Type) bool {
 		numFields := validType.NumField()
 
 		// Comment hack
@@ -84,8 +262,11 @@ func validateSource(jsonData []byte) error {
 			return true
 		}
 		for i := 0; i < numFields; i++ {
-			tag := validType.Field(i).Tag
-			value, ok := tag.Lookup("json")
+			structField := validType.Field(i)
+			if structField.Anonymous && validField(field, structField.Type) {
+				return true
+			}
+			value, ok := structField.Tag.Lookup("json")
 			if ok && value == field {
 				return true
 			}
@@ -112,6 +293,81 @@ func validateSource(jsonData []byte) error {
 		}
 	}
 
+	if tableSettings, ok := parsed["tableSettings"]; ok {
+		for _, v := range tableSettings.(map[string]interface{}) {
+			entry := v.(map[string]interface{})
+			settingsType := reflect.TypeOf(template.TableSettings)
+			for k := range entry {
+				if !validField(k, settingsType.Elem()) {
+					return fmt.Errorf("Unknown table setting %q", k)
+				}
+			}
+		}
+	}
+
+	for _, connectionList := range []string{"sources", "targets"} {
+		if connections, ok := parsed[connectionList].([]interface{}); ok {
+			for _, v := range connections {
+				entry, isObject := v.(map[string]interface{})
+				if !isObject {
+					return fmt.Errorf("'%s' entries should be objects", connectionList)
+				}
+				for k := range entry {
+					if !validField(k, reflect.TypeOf(ConnectionSettings{})) {
+						return fmt.Errorf("Unknown %s setting %q", connectionList, k)
+					}
+				}
+			}
+		}
+	}
+
+	validObject := func(parent map[string]interface{}, name string, validType reflect.Type) error {
+		value, ok := parent[name]
+		if !ok {
+			return nil
+		}
+		entry, isObject := value.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("%q should be an object", name)
+		}
+		for k := range entry {
+			if !validField(k, validType) {
+				return fmt.Errorf("Unknown %s setting %q", name, k)
+			}
+		}
+		return nil
+	}
+
+	err = validObject(parsed, "adaptiveThrottle", reflect.TypeOf(template.AdaptiveThrottle))
+	if err != nil {
+		return err
+	}
+
+	scheduleType := reflect.TypeOf(ScheduleSettings{})
+	err = validObject(parsed, "schedule", scheduleType)
+	if err != nil {
+		return err
+	}
+	for _, tableMap := range []string{"filteredTables", "tableSettings"} {
+		if tables, ok := parsed[tableMap]; ok {
+			for _, v := range tables.(map[string]interface{}) {
+				entry := v.(map[string]interface{})
+				err = validObject(entry, "schedule", scheduleType)
+				if err != nil {
+					return err
+				}
+				if transforms, ok := entry["transforms"].(map[string]interface{}); ok {
+					for column := range transforms {
+						err = validObject(transforms, column, reflect.TypeOf(ColumnTransform{}))
+						if err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -149,3 +405,256 @@ func (cfg Config) validateUses() error {
 
 	return nil
 }
+
+func (cfg Config) validateTableSettings() error {
+	for table := range cfg.TableSettings {
+		found := false
+		for _, plainTable := range cfg.SourceTables {
+			if table == plainTable {
+				found = true
+				break
+			}
+		}
+		if !found {
+			if _, filtered := cfg.FilteredSourceTables[table]; filtered {
+				return fmt.Errorf("settings for filtered table %q should be set in the 'filteredTables' entry", table)
+			}
+			return fmt.Errorf("unknown table %q in 'tableSettings'", table)
+		}
+	}
+	return nil
+}
+
+func (settings AdaptiveThrottleSettings) validate() error {
+	if !settings.Enabled {
+		return nil
+	}
+	if settings.MaxActiveBackends == 0 && settings.MaxReplicationLagSeconds == 0 && settings.MaxProbeLatencyMs == 0 {
+		return fmt.Errorf("'adaptiveThrottle' needs at least one load threshold")
+	}
+	if settings.SampleIntervalSeconds <= 0 {
+		return fmt.Errorf("'adaptiveThrottle' sample interval must be positive")
+	}
+	if settings.MaxProbeLatencyMs > 0 && len(settings.ProbeQuery) == 0 {
+		return fmt.Errorf("'adaptiveThrottle' probe query is not set")
+	}
+	return nil
+}
+
+func (cfg Config) validateSchedules() error {
+	_, err := cfg.Schedule.parse()
+	if err != nil {
+		return fmt.Errorf("invalid job schedule: %w", err)
+	}
+	for _, table := range cfg.allTables() {
+		_, err = cfg.tableSettings(table).Schedule.parse()
+		if err != nil {
+			return fmt.Errorf("invalid schedule for table %q: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func (cfg Config) validateTableOverrides() error {
+	for _, table := range cfg.allTables() {
+		settings := cfg.tableSettings(table)
+		if len(settings.Columns) > 0 && len(settings.ExcludeColumns) > 0 {
+			return fmt.Errorf("cannot set both 'columns' and 'excludeColumns' for table %q", table)
+		}
+		for column, transform := range settings.Transforms {
+			err := transform.validate()
+			if err != nil {
+				return fmt.Errorf("invalid transform for column %q of table %q: %w", column, table, err)
+			}
+		}
+		tableCfg := cfg.forTable(table)
+		if tableCfg.UpdateChunkSize == 0 || tableCfg.DeleteChunkSize == 0 ||
+			tableCfg.MinDeleteChunkSize == 0 || tableCfg.CopyChunkSize == 0 {
+			return fmt.Errorf("chunk sizes for table %q must be positive", table)
+		}
+		if tableCfg.MinDeleteChunkSize > tableCfg.DeleteChunkSize {
+			return fmt.Errorf("'minDeleteChunkSize' for table %q is larger than 'deleteChunkSize'", table)
+		}
+		if tableCfg.ThrottlePercentage <= 0 || tableCfg.ThrottlePercentage > 100 {
+			return fmt.Errorf("'throttlePercentage' for table %q must be in the range (0, 100]", table)
+		}
+		if tableCfg.FullCopyThreshold < 0 {
+			return fmt.Errorf("'fullCopyThreshold' for table %q cannot be negative", table)
+		}
+		if tableCfg.ApplyStrategy != applyReplace && tableCfg.ApplyStrategy != applyUpsert {
+			return fmt.Errorf("unknown 'applyStrategy' %q for table %q", tableCfg.ApplyStrategy, table)
+		}
+	}
+	return nil
+}
+
+// forTable returns the config with any overrides for the given table applied
+func (cfg Config) forTable(table string) Config {
+	overrides := cfg.tableSettings(table).TableOverrides
+	if overrides.UpdateChunkSize != nil {
+		cfg.UpdateChunkSize = *overrides.UpdateChunkSize
+	}
+	if overrides.DeleteChunkSize != nil {
+		cfg.DeleteChunkSize = *overrides.DeleteChunkSize
+	}
+	if overrides.MinDeleteChunkSize != nil {
+		cfg.MinDeleteChunkSize = *overrides.MinDeleteChunkSize
+	}
+	if overrides.CopyChunkSize != nil {
+		cfg.CopyChunkSize = *overrides.CopyChunkSize
+	}
+	if overrides.ThrottlePercentage != nil {
+		cfg.ThrottlePercentage = *overrides.ThrottlePercentage
+	}
+	if overrides.SyncUpdates != nil {
+		cfg.SyncUpdates = *overrides.SyncUpdates
+	}
+	if overrides.SyncDeletes != nil {
+		cfg.SyncDeletes = *overrides.SyncDeletes
+	}
+	if overrides.FullCopyThreshold != nil {
+		cfg.FullCopyThreshold = *overrides.FullCopyThreshold
+	}
+	if overrides.ApplyStrategy != nil {
+		cfg.ApplyStrategy = *overrides.ApplyStrategy
+	}
+	return cfg
+}
+
+func (cfg Config) validateTargetTables() error {
+	sources := make(map[string]string)
+	for _, table := range cfg.allTables() {
+		targetTable := cfg.targetTable(table)
+		namespace, name := splitTablePath(targetTable)
+		qualified := namespace + "." + name
+		if other, found := sources[qualified]; found {
+			return fmt.Errorf("tables %q and %q are both synced to target table %q", other, table, qualified)
+		}
+		sources[qualified] = table
+	}
+	return nil
+}
+
+func (cfg Config) validateSources() error {
+	if len(cfg.Sources) == 0 {
+		return nil
+	}
+	if len(cfg.SourceConnection) > 0 {
+		return fmt.Errorf("cannot set both 'source' and 'sources'")
+	}
+	if len(cfg.SourceColumn) == 0 {
+		return fmt.Errorf("'sourceColumn' cannot be empty")
+	}
+	if cfg.ShadowCopy {
+		return fmt.Errorf("'shadowCopy' cannot be combined with multiple sources")
+	}
+	return validateConnections("source", cfg.Sources)
+}
+
+func (cfg Config) validateTargets() error {
+	if len(cfg.Targets) == 0 {
+		return nil
+	}
+	if len(cfg.TargetConnection) > 0 {
+		return fmt.Errorf("cannot set both 'target' and 'targets'")
+	}
+	if cfg.AtomicApply {
+		return fmt.Errorf("'atomicApply' cannot be combined with multiple targets")
+	}
+	return validateConnections("target", cfg.Targets)
+}
+
+// validateLocalTarget checks that SQLite and file export targets are only used
+// with features that they support
+func (cfg Config) validateLocalTarget() error {
+	for _, target := range cfg.Targets {
+		if isSQLiteConnection(target.Connection) || isExportConnection(target.Connection) {
+			return fmt.Errorf("SQLite and file export targets cannot be used in 'targets'")
+		}
+	}
+
+	var kind, example string
+	switch {
+	case isSQLiteConnection(cfg.TargetConnection):
+		kind, example = "SQLite", sqlitePrefix+"local.db"
+	case isExportConnection(cfg.TargetConnection):
+		kind, example = "file export", exportPrefix+"extracts"
+	default:
+		return nil
+	}
+	if cfg.TargetConnection == sqlitePrefix || cfg.TargetConnection == exportPrefix {
+		return fmt.Errorf("%s targets need a path, like %q", kind, example)
+	}
+	switch {
+	case len(cfg.Sources) > 0:
+		return fmt.Errorf("a %s target cannot be combined with multiple sources", kind)
+	case cfg.ShadowCopy:
+		return fmt.Errorf("a %s target cannot be combined with 'shadowCopy'", kind)
+	case cfg.AtomicApply:
+		return fmt.Errorf("a %s target cannot be combined with 'atomicApply'", kind)
+	case cfg.Parallelism > 1 || cfg.DeleteParallelism > 1:
+		return fmt.Errorf("a %s target cannot be combined with parallel syncing", kind)
+	}
+
+	if isExportConnection(cfg.TargetConnection) {
+		if cfg.VerifyContent {
+			return fmt.Errorf("a file export target cannot be combined with 'verifyContent'")
+		}
+		switch cfg.ExportFormat {
+		case exportCSV, exportJSONL, exportParquet:
+		default:
+			return fmt.Errorf("unknown export format %q", cfg.ExportFormat)
+		}
+	}
+	return nil
+}
+
+func validateConnections(kind string, connections []ConnectionSettings) error {
+	names := make(map[string]bool)
+	for _, connection := range connections {
+		if len(connection.Name) == 0 || len(connection.Connection) == 0 {
+			return fmt.Errorf("%ss need both a 'name' and a 'connection'", kind)
+		}
+		if names[connection.Name] {
+			return fmt.Errorf("duplicate %s name %q", kind, connection.Name)
+		}
+		names[connection.Name] = true
+	}
+	return nil
+}
+
+// targetTable returns the target table name for a source table, applying any
+// "targetTable" setting or schema mapping. Unmapped names are returned as is.
+func (cfg Config) targetTable(table string) string {
+	settings := cfg.tableSettings(table)
+	namespace, name := splitTablePath(table)
+	if len(settings.TargetTable) > 0 {
+		if strings.Contains(settings.TargetTable, ".") {
+			return settings.TargetTable
+		}
+		name = settings.TargetTable
+	}
+	if mapped, found := cfg.SchemaMapping[namespace]; found {
+		namespace = mapped
+	} else if len(settings.TargetTable) == 0 {
+		return table
+	}
+	return namespace + "." + name
+}
+
+// allTables returns all plain and filtered tables
+func (cfg Config) allTables() []string {
+	tables := append([]string{}, cfg.SourceTables...)
+	for table := range cfg.FilteredSourceTables {
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// tableSettings returns the settings for a plain or filtered table
+func (cfg Config) tableSettings(table string) TableSettings {
+	if filtered, found := cfg.FilteredSourceTables[table]; found {
+		return filtered.TableSettings
+	}
+	return cfg.TableSettings[table]
+}
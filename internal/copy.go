@@ -1,6 +1,8 @@
 package sslr
 
 import (
+	"context"
+	"crypto/md5"
 	"fmt"
 	"strings"
 
@@ -8,43 +10,232 @@ import (
 	"github.com/jackc/pgx/v4"
 )
 
-func (job *Job) copyFullTable(table string, where string) error {
-	var whereClause string
-	if len(where) > 0 {
-		whereClause = "where " + where
+// copyFullTable replaces all target rows with the source table contents
+func (job *Job) copyFullTable(table string, primaryKeys []string, where string) error {
+	// Unbatched copies are not paused for blackouts once started
+	err := job.pauseForBlackouts(table)
+	if err != nil {
+		return err
+	}
+
+	if job.cfg.ShadowCopy {
+		return job.copyFullTableToShadow(table, primaryKeys, where)
 	}
-	q := fmt.Sprintf("select * from %s %s", table, whereClause)
-	rows, err := job.source.Query(job.ctx, q)
+
+	targetTable := job.cfg.targetTable(table)
+	throttle := newThrottle("copy", job.throttleBudget, job.cfg.ThrottlePercentage)
+	err = job.targetSink().replaceTable(job.ctx, targetTable, job.targetWhere(""), func(target rowCopier) error {
+		logger.Info.Printf("Running throttled copy")
+		return job.copyRows(throttle, target, table, targetTable, primaryKeys, where, nil, nil)
+	})
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
+	// Waiting after the commit, since unbatched copies are not paused
+	throttle.consumeRecorded()
+	throttle.wait()
+	return nil
+}
 
-	var columnNames []string
-	columns := rows.FieldDescriptions()
-	for _, column := range columns {
-		columnNames = append(columnNames, string(column.Name))
+// shadowSuffix is added to table and index names of shadow copies
+const shadowSuffix = "__sslr_shadow"
+
+// stagedCopySuffix is added to the table names of staged batched copies
+const stagedCopySuffix = "__sslr_copy"
+
+func shadowTableName(table string) string {
+	namespace, name := splitTablePath(table)
+	return fmt.Sprintf("%s.%s", namespace, suffixedName(name, shadowSuffix))
+}
+
+// stagedCopyTableName returns the table that batched copies without shadowCopy are
+// staged in. Each source of a fan-in job stages its rows separately.
+func (job *Job) stagedCopyTableName(table string) string {
+	namespace, name := splitTablePath(table)
+	suffix := stagedCopySuffix
+	if job.fanIn() {
+		suffix = fmt.Sprintf("%s_%x", stagedCopySuffix, md5.Sum([]byte(job.sourceName)))[:len(stagedCopySuffix)+9]
 	}
+	return fmt.Sprintf("%s.%s", namespace, suffixedName(name, suffix))
+}
 
-	tx, err := job.target.Begin(job.ctx)
+// checkShadowSwap makes sure that the target table can be dropped when swapping
+// in a shadow copy. Dependent views and foreign keys would have to be dropped too,
+// so they are left for the user to handle.
+func (job *Job) checkShadowSwap(table string) error {
+	targetTable := job.cfg.targetTable(table)
+	dependents, err := dependentObjects(job.ctx, job.target, targetTable)
+	if err != nil {
+		return fmt.Errorf("failed to check dependent objects: %w", err)
+	}
+	if len(dependents) > 0 {
+		return fmt.Errorf("target table %q cannot be replaced by a shadow copy, since it is used by %s",
+			targetTable, strings.Join(dependents, ", "))
+	}
+	return nil
+}
+
+// syncFullTable copies a full table, and updates the table state to continue
+// syncing from the copy. Tables with primary keys are copied to Postgres targets
+// in resumable batches.
+func (job *Job) syncFullTable(table string, primaryKeys []string, where string, updRange updateRange) error {
+	if job.sink == nil && len(primaryKeys) > 0 {
+		return job.copyFullTableInBatches(table, primaryKeys, where, updRange)
+	}
+
+	err := job.copyFullTable(table, primaryKeys, where)
+	if err != nil {
+		return err
+	}
+	return job.setTableCheckedState(table, updRange.endXmin, updRange.txids.xmin)
+}
+
+// copyFullTableToShadow copies the full table to a new shadow table, which then
+// replaces the target table. The old table stays readable until the swap.
+func (job *Job) copyFullTableToShadow(table string, primaryKeys []string, where string) error {
+	shadow := shadowTableName(job.cfg.targetTable(table))
+
+	err := job.checkShadowSwap(table)
+	if err != nil {
+		return err
+	}
+
+	err = job.createCopyTable(table, shadow)
 	if err != nil {
 		return err
 	}
 
+	logger.Info.Printf("Running throttled copy to shadow table")
+	throttle := newThrottle("copy", job.throttleBudget, job.cfg.ThrottlePercentage)
+	err = job.copyRows(throttle, job.target, table, shadow, primaryKeys, where, nil, nil)
+	if err != nil {
+		return err
+	}
+	throttle.consumeRecorded()
+	throttle.wait()
+
+	return job.replaceWithShadowTable(table, shadow)
+}
+
+// copyFullTableInBatches copies the full table in primary key order,
+// checkpointing the last copied key in the table state after each batch.
+// An interrupted copy is resumed from the checkpoint.
+//
+// With shadowCopy, the batches are copied to a shadow table, which then replaces
+// the target table. Otherwise, the batches are copied to a staging table, which
+// replaces the target rows in a single transaction when all batches are done.
+func (job *Job) copyFullTableInBatches(table string, primaryKeys []string, where string, updRange updateRange) error {
+	var destination string
+	if job.cfg.ShadowCopy {
+		destination = shadowTableName(job.cfg.targetTable(table))
+
+		err := job.checkShadowSwap(table)
+		if err != nil {
+			return err
+		}
+	} else {
+		destination = job.stagedCopyTableName(job.cfg.targetTable(table))
+	}
+
+	state, err := job.getTableState(table)
+	if err != nil {
+		return err
+	}
+
+	resume := false
+	if state.copyInProgress() {
+		resume, err = job.canResumeCopy(table, destination)
+		if err != nil {
+			return err
+		}
+		if !resume {
+			logger.Info.Printf("Cannot resume interrupted copy of table %s, restarting", table)
+		}
+	}
+
+	if resume {
+		logger.Info.Printf("Resuming interrupted copy of table %s", table)
+	} else {
+		state.copyKey = nil
+		state.copyStartXmin = updRange.endXmin
+		state.copyCheckedXid = updRange.txids.xmin
+		err = job.createCopyTable(table, destination)
+		if err != nil {
+			return err
+		}
+		err = job.setTableState(table, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	if job.cfg.ShadowCopy {
+		logger.Info.Printf("Running batched copy to shadow table")
+	} else {
+		logger.Info.Printf("Running batched copy to staging table")
+	}
+	throttle := newThrottle("copy", job.throttleBudget, job.cfg.ThrottlePercentage)
+	err = job.copyRows(throttle, job.target, table, destination, primaryKeys, where, state.copyKey, func(tx pgx.Tx, lastKey []string) error {
+		state.copyKey = lastKey
+		return job.writeTableState(tx, table, state)
+	})
+	if err != nil {
+		return err
+	}
+
+	state.lastSeenXmin = state.copyStartXmin
+	state.checkedXid = state.copyCheckedXid
+	state.copyKey = nil
+	state.copyStartXmin = 0
+	state.copyCheckedXid = 0
+
+	if !job.cfg.ShadowCopy {
+		return job.replaceFromStagingTable(table, destination, state)
+	}
+
+	err = job.replaceWithShadowTable(table, destination)
+	if err != nil {
+		return err
+	}
+	return job.setTableState(table, state)
+}
+
+// replaceFromStagingTable replaces the target rows with the rows of a completed
+// staged copy, and stores the table state, in a single transaction
+func (job *Job) replaceFromStagingTable(table string, staging string, state tableState) error {
+	tx, err := job.target.Begin(job.ctx)
+	if err != nil {
+		return err
+	}
 	defer func() {
 		if tx != nil {
 			tx.Rollback(job.ctx)
 		}
 	}()
 
-	_, err = tx.Exec(job.ctx, fmt.Sprintf("delete from %s", table))
+	logger.Info.Printf("Replacing table %s with staged copy", table)
+	targetTable := job.cfg.targetTable(table)
+	var whereClause string
+	if where := job.targetWhere(""); len(where) > 0 {
+		whereClause = "where " + where
+	}
+	_, err = tx.Exec(job.ctx, fmt.Sprintf("delete from %s %s", targetTable, whereClause))
 	if err != nil {
 		return fmt.Errorf("failed to delete old data: %w", err)
 	}
 
-	logger.Info.Printf("Running streaming copy")
-	identifier := strings.Split(table, ".")
-	updatedRows, err := tx.CopyFrom(job.ctx, identifier, columnNames, newReportingSource(rows))
+	// The staging table is created from the target schema, with the same column order
+	_, err = tx.Exec(job.ctx, fmt.Sprintf("insert into %s select * from %s", targetTable, staging))
+	if err != nil {
+		return fmt.Errorf("failed to insert staged copy: %w", err)
+	}
+
+	_, err = tx.Exec(job.ctx, fmt.Sprintf("drop table %s", staging))
+	if err != nil {
+		return fmt.Errorf("failed to drop staging table: %w", err)
+	}
+
+	err = job.writeTableState(tx, table, state)
 	if err != nil {
 		return err
 	}
@@ -53,7 +244,287 @@ func (job *Job) copyFullTable(table string, where string) error {
 	if err != nil {
 		return err
 	}
-	job.updatedRows += uint32(updatedRows)
+	tx = nil
+	return nil
+}
+
+// copyCheckpoint is called in the target transaction of each copied batch,
+// with the text encoded primary key of the last copied row
+type copyCheckpoint func(tx pgx.Tx, lastKey []string) error
+
+// copyRows copies source table rows to the "destination" target table, throttled.
+// Tables with primary keys are read in key order, in batches of "copyChunkSize" rows,
+// starting after "startKey". When "checkpoint" is set, each batch is written in a separate
+// transaction, waiting for throttling between batches.
+//
+// Without "checkpoint", all rows are written in the caller's transaction, and tables without
+// keys are read in a single stream. The copy is then never paused, and the caller waits
+// for throttling after committing the copy.
+func (job *Job) copyRows(throttle *throttledOperation, target rowCopier, table string, destination string, primaryKeys []string, where string, startKey []string, checkpoint copyCheckpoint) error {
+	identifier := strings.Split(destination, ".")
+
+	if len(primaryKeys) == 0 {
+		var whereClause string
+		if len(where) > 0 {
+			whereClause = "where " + where
+		}
+
+		throttle.start()
+		q := fmt.Sprintf("select %s from %s %s", job.selectList(table), table, whereClause)
+		rows, err := job.source.Query(job.ctx, q)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		columnNames := fieldNames(rows)
+		source := newReportingSource(job.newDiscriminatorSource(newTransformingSource(newThrottledSource(rows, throttle), job.rowTransformer(table, columnNames))))
+		copied, err := target.CopyFrom(job.ctx, identifier, job.targetColumns(columnNames), source)
+		if err != nil {
+			return err
+		}
+		rows.Close()
+		throttle.end()
+
+		job.updatedRows += uint32(copied)
+		return nil
+	}
+
+	var extraWhereClause string
+	if len(where) > 0 {
+		extraWhereClause = "and " + where
+	}
+
+	var keySorting []string
+	for _, key := range primaryKeys {
+		keySorting = append(keySorting, fmt.Sprintf("%s asc", key))
+	}
+	orderClause := strings.Join(keySorting, ", ")
+
+	keyTypes, err := job.getPrimaryKeyTypes(table, primaryKeys)
+	if err != nil {
+		return err
+	}
+	connInfo := job.source.ConnInfo()
+	reporter := &reportingSource{batched: true}
+	lastKey := startKey
+
+	for {
+		throttle.start()
+
+		queryParameters := []interface{}{job.cfg.CopyChunkSize}
+		cursorClause := "true"
+		if lastKey != nil {
+			cursorClause = textTupleComparison(primaryKeys, keyTypes, ">", 2)
+			for _, key := range lastKey {
+				queryParameters = append(queryParameters, key)
+			}
+		}
+
+		q := fmt.Sprintf(`--sql
+		select
+			%[5]s
+		from
+			%[1]s
+		where
+			%[2]s
+			%[3]s
+		order by
+			%[4]s
+		limit
+			$1
+		;`, table, cursorClause, extraWhereClause, orderClause, job.selectList(table))
+
+		rows, err := job.source.Query(job.ctx, q, queryParameters...)
+		if err != nil {
+			return err
+		}
+		columnNames := fieldNames(rows)
+		transformer := job.rowTransformer(table, columnNames)
+
+		batchKey := func() ([]string, error) {
+			if reporter.lastValues == nil {
+				return lastKey, nil
+			}
+			key := make([]string, len(primaryKeys))
+			for i, keyIndex := range keyColumnIndices(primaryKeys, columnNames) {
+				text, err := PrimaryKey{reporter.lastValues[keyIndex]}.Text(connInfo, keyTypes[i].oid)
+				if err != nil {
+					return nil, err
+				}
+				key[i] = text
+			}
+			return key, nil
+		}
+
+		source := job.newDiscriminatorSource(newTransformingSource(newThrottledSource(rows, throttle), transformer))
+		var copied int64
+		if checkpoint != nil {
+			// Checkpointed copies write directly to the target connection
+			copied, err = job.copyBatch(job.target, identifier, job.targetColumns(columnNames), reporter.reset(source), func(tx pgx.Tx) error {
+				key, err := batchKey()
+				if err != nil {
+					return err
+				}
+				return checkpoint(tx, key)
+			})
+		} else {
+			copied, err = target.CopyFrom(job.ctx, identifier, job.targetColumns(columnNames), reporter.reset(source))
+		}
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		throttle.end()
+		if checkpoint != nil {
+			throttle.consumeRecorded()
+		}
+
+		job.updatedRows += uint32(copied)
+		if copied < int64(job.cfg.CopyChunkSize) {
+			break
+		}
+
+		lastKey, err = batchKey()
+		if err != nil {
+			return err
+		}
+
+		// Without checkpoints, all batches are written in the same target transaction
+		if checkpoint != nil {
+			throttle.wait()
+			err = job.pauseForBlackouts(table)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	logger.Info.Printf("Done copying, %v rows in total", reporter.rowsRead)
+
+	return nil
+}
+
+func fieldNames(rows pgx.Rows) []string {
+	var columnNames []string
+	for _, column := range rows.FieldDescriptions() {
+		columnNames = append(columnNames, string(column.Name))
+	}
+	return columnNames
+}
+
+// copyBatch copies rows to the target in a transaction, calling "checkpoint"
+// before committing
+func (job *Job) copyBatch(target dbConn, identifier pgx.Identifier, columnNames []string, rows pgx.CopyFromSource, checkpoint func(tx pgx.Tx) error) (int64, error) {
+	tx, err := target.Begin(job.ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback(job.ctx)
+		}
+	}()
+
+	copied, err := tx.CopyFrom(job.ctx, identifier, columnNames, rows)
+	if err != nil {
+		return 0, err
+	}
+
+	err = checkpoint(tx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to checkpoint copy: %w", err)
+	}
+
+	err = tx.Commit(job.ctx)
+	if err != nil {
+		return 0, err
+	}
+	tx = nil
+	return copied, nil
+}
+
+// canResumeCopy checks that a shadow or staging table from an interrupted copy
+// still matches the source table
+func (job *Job) canResumeCopy(table string, destination string) (bool, error) {
+	exists, err := objectExists(job.ctx, job.target, destination)
+	if err != nil || !exists {
+		return false, err
+	}
+	destinationSchema, err := extractTableSchema(job.ctx, job.target, destination, nil)
+	if err != nil {
+		return false, err
+	}
+	return destinationSchema == renameTableSchema(job.targetSchema(job.schemas[table]), destination), nil
+}
+
+// createCopyTable creates an empty shadow or staging table, without indices,
+// replacing any table left by an earlier copy
+func (job *Job) createCopyTable(table string, destination string) error {
+	_, err := job.target.Exec(job.ctx, fmt.Sprintf("drop table if exists %s", destination))
+	if err != nil {
+		return fmt.Errorf("failed to drop old copy table: %w", err)
+	}
+	err = createTable(job.ctx, job.target, destination, renameTableSchema(job.targetSchema(job.schemas[table]), destination))
+	if err != nil {
+		return fmt.Errorf("failed to create copy table: %w", err)
+	}
+	return nil
+}
+
+// replaceWithShadowTable indexes the shadow table and swaps it in
+func (job *Job) replaceWithShadowTable(table string, shadow string) error {
+	logger.Info.Printf("Creating shadow table indices")
+	indices := job.targetIndices(job.indices[table])
+	for _, index := range indices {
+		err := createIndex(job.ctx, job.target, shadow, index, suffixedName(index.indexName, shadowSuffix), false)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Info.Printf("Swapping in shadow table")
+	err := swapShadowTable(job.ctx, job.target, job.cfg.targetTable(table), shadow, indices)
+	if err != nil {
+		return fmt.Errorf("failed to swap in shadow table: %w", err)
+	}
+	return nil
+}
+
+// swapShadowTable replaces a table with its shadow copy in a single transaction
+func swapShadowTable(ctx context.Context, target dbConn, table string, shadow string, indices []tableIndex) error {
+	tx, err := target.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	_, err = tx.Exec(ctx, fmt.Sprintf("drop table %s", table))
+	if err != nil {
+		return err
+	}
+
+	namespace, name := splitTablePath(table)
+	_, err = tx.Exec(ctx, fmt.Sprintf("alter table %s rename to %s", shadow, name))
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indices {
+		q := fmt.Sprintf("alter index %s.%s rename to %s", namespace, suffixedName(index.indexName, shadowSuffix), index.indexName)
+		_, err = tx.Exec(ctx, q)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
 	tx = nil
 	return nil
 }
@@ -61,15 +532,25 @@ func (job *Job) copyFullTable(table string, where string) error {
 type reportingSource struct {
 	wrapped  pgx.CopyFromSource
 	rowsRead uint32
+	// Batched sources are reset for each batch, and leave
+	// reporting the total to the caller
+	batched    bool
+	lastValues []interface{}
 }
 
 func newReportingSource(source pgx.CopyFromSource) pgx.CopyFromSource {
 	return &reportingSource{
-		source,
-		0,
+		wrapped: source,
 	}
 }
 
+// reset starts reading the next batch from a new source
+func (r *reportingSource) reset(source pgx.CopyFromSource) pgx.CopyFromSource {
+	r.wrapped = source
+	r.lastValues = nil
+	return r
+}
+
 func (r *reportingSource) Next() bool {
 	hasNext := r.wrapped.Next()
 	if hasNext {
@@ -90,16 +571,40 @@ func (r *reportingSource) Next() bool {
 		if r.rowsRead%reportInterval == 0 {
 			logger.Info.Printf("Read %v rows", r.rowsRead)
 		}
-	} else {
+	} else if !r.batched {
 		logger.Info.Printf("Done reading, %v rows in total", r.rowsRead)
 	}
 	return hasNext
 }
 
 func (r *reportingSource) Values() ([]interface{}, error) {
-	return r.wrapped.Values()
+	values, err := r.wrapped.Values()
+	r.lastValues = values
+	return values, err
 }
 
 func (r *reportingSource) Err() error {
 	return r.wrapped.Err()
 }
+
+// throttledSource records rows read from a streaming source in a throttled operation,
+// see throttledOperation.record.
+type throttledSource struct {
+	pgx.Rows
+	throttle *throttledOperation
+}
+
+func newThrottledSource(rows pgx.Rows, throttle *throttledOperation) pgx.CopyFromSource {
+	return &throttledSource{
+		Rows:     rows,
+		throttle: throttle,
+	}
+}
+
+func (t *throttledSource) Next() bool {
+	hasNext := t.Rows.Next()
+	if hasNext {
+		t.throttle.record(1, rawRowSize(t.Rows))
+	}
+	return hasNext
+}
@@ -0,0 +1,74 @@
+package sslr
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestStagedCopyTableName(t *testing.T) {
+	job := &Job{}
+	if name := job.stagedCopyTableName("public.items"); name != "public.items__sslr_copy" {
+		t.Errorf("staging table = %q, expected public.items__sslr_copy", name)
+	}
+
+	first := &Job{sourceName: "first"}
+	second := &Job{sourceName: "second"}
+	long := "public." + strings.Repeat("a", 60)
+	firstName := first.stagedCopyTableName(long)
+	if firstName == second.stagedCopyTableName(long) {
+		t.Errorf("sources share staging table %q", firstName)
+	}
+	_, name := splitTablePath(firstName)
+	if len(name) > maxIdentifierLength {
+		t.Errorf("staging table name %q is too long", name)
+	}
+}
+
+func TestBatchedCopyThroughStagingTable(t *testing.T) {
+	conn := testConnection(t)
+	ctx := context.Background()
+
+	cleanup := `--sql
+	drop schema if exists staged_copy_target cascade;
+	drop table if exists public.staged_copy_items, public.staged_copy_state;
+	`
+	_, err := conn.Exec(ctx, cleanup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Exec(context.Background(), cleanup)
+	})
+	_, err = conn.Exec(ctx, `--sql
+	create schema staged_copy_target;
+	create table public.staged_copy_items (id int primary key, name text);
+	insert into public.staged_copy_items select i, 'item ' || i from generate_series(1, 25) i;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runTestJob(t, map[string]interface{}{
+		"tables":        []string{"public.staged_copy_items"},
+		"schemaMapping": map[string]string{"public": "staged_copy_target"},
+		"stateTable":    "staged_copy_state",
+		"copyChunkSize": 10,
+	})
+
+	var rows int
+	err = conn.QueryRow(ctx, "select count(*) from staged_copy_target.staged_copy_items").Scan(&rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 25 {
+		t.Errorf("target has %d of 25 copied rows", rows)
+	}
+	exists, err := objectExists(ctx, conn, "staged_copy_target.staged_copy_items__sslr_copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("expected the staging table to be dropped")
+	}
+}
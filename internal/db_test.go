@@ -0,0 +1,27 @@
+package sslr
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Database tests run against the Postgres database in SSLR_TEST_DATABASE,
+// like "postgres://postgres@localhost/sslr_test", and are skipped without it.
+func testConnection(t *testing.T) *pgx.Conn {
+	t.Helper()
+	url := os.Getenv("SSLR_TEST_DATABASE")
+	if url == "" {
+		t.Skip("SSLR_TEST_DATABASE not set")
+	}
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close(context.Background())
+	})
+	return conn
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strings"
 
 	"github.com/erkkah/letarette/pkg/logger"
@@ -16,7 +18,8 @@ func (job *Job) syncDeletedRows(table string, where string) error {
 		return err
 	}
 
-	keyRange, err := getPrimaryKeyRange(job.ctx, job.source, table, primaryKeys, where)
+	sourceKeys := job.sourceKeyExpressions(table, primaryKeys)
+	keyRange, err := getPrimaryKeyRange(job.ctx, job.source, table, sourceKeys, where)
 	if err != nil {
 		return fmt.Errorf("failed to get primary key range: %w", err)
 	}
@@ -25,39 +28,109 @@ func (job *Job) syncDeletedRows(table string, where string) error {
 	if keyRange.count < chunkSize {
 		chunkSize = keyRange.count
 	}
-	startKey := keyRange.min
-	throttle := newThrottle("deletes", job.cfg.ThrottlePercentage)
+
+	partitionStarts := PrimaryKeySetSlice{keyRange.min}
+	if job.cfg.DeleteParallelism > 1 && keyRange.count > chunkSize {
+		bounds, err := getPartitionBounds(job.ctx, job.source, table, sourceKeys, keyRange, int(job.cfg.DeleteParallelism), where)
+		if err != nil {
+			return fmt.Errorf("failed to partition primary key range: %w", err)
+		}
+		partitionStarts = append(partitionStarts, bounds...)
+	}
+
+	if len(partitionStarts) == 1 {
+		return job.syncDeletedRowPartition(table, primaryKeys, keyRange.min, nil, chunkSize, where)
+	}
+
+	logger.Info.Printf("Scanning table %s in %d parallel partitions", table, len(partitionStarts))
+
+	ctx, cancel := context.WithCancel(job.ctx)
+	defer cancel()
+
+	workers, err := job.startWorkers(ctx, len(partitionStarts))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The first worker shares connections with the job
+		for _, worker := range workers[1:] {
+			worker.close(nil)
+		}
+	}()
+
+	errs := make(chan error, len(workers))
+	for i, worker := range workers {
+		var limitKey PrimaryKeySet
+		if i+1 < len(partitionStarts) {
+			limitKey = partitionStarts[i+1]
+		}
+		go func(worker *Job, startKey PrimaryKeySet, limitKey PrimaryKeySet) {
+			err := worker.syncDeletedRowPartition(table, primaryKeys, startKey, limitKey, chunkSize, where)
+			if err != nil {
+				cancel()
+			}
+			errs <- err
+		}(worker, partitionStarts[i], limitKey)
+	}
+
+	var firstError error
+	for range workers {
+		err := <-errs
+		if err != nil && firstError == nil {
+			firstError = err
+		}
+	}
+	for _, worker := range workers {
+		job.updatedRows += worker.updatedRows
+	}
+
+	return firstError
+}
+
+// syncDeletedRowPartition scans the key range from startKey to limitKey in chunks.
+// A nil limitKey scans to the end of the table.
+func (job *Job) syncDeletedRowPartition(table string, primaryKeys []string, startKey PrimaryKeySet, limitKey PrimaryKeySet, chunkSize uint32, where string) error {
+	throttle := newThrottle("deletes", job.throttleBudget, job.cfg.ThrottlePercentage)
 
 	for {
 		throttle.start()
-		endKey, err := job.syncDeletedRowRange(table, primaryKeys, startKey, chunkSize, where)
+		endKey, err := job.syncDeletedRowRange(throttle, table, primaryKeys, startKey, limitKey, chunkSize, where)
+		throttle.end()
 		if err != nil {
 			return err
 		}
+		throttle.consumeRecorded()
 
 		if endKey.Equals(startKey) {
 			break
 		}
 		startKey = endKey
-		throttle.end()
 		throttle.wait()
+
+		err = job.pauseForBlackouts(table)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (job *Job) syncDeletedRowRange(table string, primaryKeys []string, startKey PrimaryKeySet, chunkSize uint32, where string) (endKey PrimaryKeySet, err error) {
-	endKey, err = getKeyAtOffset(job.ctx, job.source, table, primaryKeys, startKey, chunkSize, where)
+func (job *Job) syncDeletedRowRange(throttle *throttledOperation, table string, primaryKeys []string, startKey PrimaryKeySet, limitKey PrimaryKeySet, chunkSize uint32, where string) (endKey PrimaryKeySet, err error) {
+	sourceKeys := job.sourceKeyExpressions(table, primaryKeys)
+	endKey, err = getKeyAtOffset(job.ctx, job.source, table, sourceKeys, startKey, limitKey, chunkSize, where)
 	if err != nil {
 		err = fmt.Errorf("failed to get key at offset: %w", err)
 		return
 	}
-	sourceHash, err := getKeyHash(job.ctx, job.source, table, primaryKeys, startKey, endKey, where)
+	hashedColumns := job.getHashedColumns(table, primaryKeys)
+	sink := job.targetSink()
+	sourceHash, err := sink.sourceKeyHash(job.ctx, job.source, throttle, table, sourceKeys, hashedColumns, startKey, endKey, where)
 	if err != nil {
 		err = fmt.Errorf("failed to get source key hash: %w", err)
 		return
 	}
-	targetHash, err := getKeyHash(job.ctx, job.target, table, primaryKeys, startKey, endKey, where)
+	targetHash, err := sink.keyHash(job.ctx, job.cfg.targetTable(table), primaryKeys, hashedColumns, startKey, endKey, job.targetWhere(where))
 	if err != nil {
 		err = fmt.Errorf("failed to get target key hash: %w", err)
 		return
@@ -67,7 +140,7 @@ func (job *Job) syncDeletedRowRange(table string, primaryKeys []string, startKey
 	if sourceHash != targetHash {
 		if chunkSize <= job.cfg.MinDeleteChunkSize {
 			logger.Debug.Printf("Updating (%v - %v)", startKey, endKey)
-			err = job.updateChangedRange(table, primaryKeys, startKey, endKey, where)
+			err = job.updateChangedRange(throttle, table, primaryKeys, startKey, endKey, where)
 			if err != nil {
 				err = fmt.Errorf("failed to update changed range: %w", err)
 				return
@@ -75,11 +148,11 @@ func (job *Job) syncDeletedRowRange(table string, primaryKeys []string, startKey
 		} else {
 			nextChunkSize := chunkSize / 2
 			var midKey PrimaryKeySet
-			midKey, err = job.syncDeletedRowRange(table, primaryKeys, startKey, nextChunkSize, where)
+			midKey, err = job.syncDeletedRowRange(throttle, table, primaryKeys, startKey, limitKey, nextChunkSize, where)
 			if err != nil {
 				return
 			}
-			_, err = job.syncDeletedRowRange(table, primaryKeys, midKey, nextChunkSize, where)
+			_, err = job.syncDeletedRowRange(throttle, table, primaryKeys, midKey, limitKey, nextChunkSize, where)
 			if err != nil {
 				return
 			}
@@ -88,7 +161,8 @@ func (job *Job) syncDeletedRowRange(table string, primaryKeys []string, startKey
 	return endKey, nil
 }
 
-func getKeyAtOffset(ctx context.Context, conn *pgx.Conn, table string, primaryKeys []string, startKey PrimaryKeySet, offset uint32, where string) (PrimaryKeySet, error) {
+// getKeyAtOffset returns the key "offset" rows after startKey, but not after limitKey, unless nil.
+func getKeyAtOffset(ctx context.Context, conn dbConn, table string, primaryKeys []string, startKey PrimaryKeySet, limitKey PrimaryKeySet, offset uint32, where string) (PrimaryKeySet, error) {
 	var result PrimaryKeySet
 
 	if len(primaryKeys) != len(startKey) {
@@ -102,14 +176,13 @@ func getKeyAtOffset(ctx context.Context, conn *pgx.Conn, table string, primaryKe
 
 	keyList := strings.Join(primaryKeys, ",")
 
-	var filtering []string
-	var queryParameters = []interface{}{offset}
-	for i, keyValue := range startKey {
-		// "2+i" since query parameters after "offset" start at 2
-		filtering = append(filtering, fmt.Sprintf("%s >= $%d", primaryKeys[i], 2+i))
-		queryParameters = append(queryParameters, keyValue.value)
+	// Query parameters after "offset" start at 2
+	whereClause := tupleComparison(primaryKeys, ">=", 2)
+	queryParameters := append([]interface{}{offset}, startKey.Values()...)
+	if limitKey != nil {
+		whereClause += " and " + tupleComparison(primaryKeys, "<=", 2+len(startKey))
+		queryParameters = append(queryParameters, limitKey.Values()...)
 	}
-	whereClause := strings.Join(filtering, " and ")
 
 	var minSorting []string
 	var maxSorting []string
@@ -163,34 +236,23 @@ func getKeyAtOffset(ctx context.Context, conn *pgx.Conn, table string, primaryKe
 	return result, nil
 }
 
-func (job *Job) updateChangedRange(table string, primaryKeys []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string) error {
-	tx, err := job.target.Begin(job.ctx)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if tx != nil {
-			tx.Rollback(job.ctx)
-		}
-	}()
-
+func (job *Job) updateChangedRange(throttle *throttledOperation, table string, primaryKeys []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string) error {
 	var extraWhereClause string
 	if len(where) > 0 {
 		extraWhereClause = "and " + where
 	}
 
-	whereClause, queryParameters := whereClauseFromKeyRange(primaryKeys, startKey, endKey)
+	whereClause, queryParameters := whereClauseFromKeyRange(job.sourceKeyExpressions(table, primaryKeys), startKey, endKey)
 
-	baseQuery := fmt.Sprintf(`
-	--sql
+	q := fmt.Sprintf(`--sql
+	select
+		%[4]s
 	from
 		%[1]s
 	where
 		%[2]s
 		%[3]s
-	;`, table, whereClause, extraWhereClause)
-
-	q := "select * " + baseQuery
+	;`, table, whereClause, extraWhereClause, job.selectList(table))
 
 	rows, err := job.source.Query(job.ctx, q, queryParameters...)
 	if err != nil {
@@ -212,44 +274,59 @@ func (job *Job) updateChangedRange(table string, primaryKeys []string, startKey
 		columnNames = append(columnNames, string(column.Name))
 	}
 
-	d := "delete " + baseQuery
-
-	_, err = tx.Exec(job.ctx, d, queryParameters...)
+	source := newTransformingSource(newThrottledSource(rows, throttle), job.rowTransformer(table, columnNames))
+	rowsRead, err := job.targetSink().replaceRange(
+		job.ctx, job.cfg.targetTable(table), primaryKeys, startKey, endKey, job.targetWhere(where),
+		job.targetColumns(columnNames), job.newDiscriminatorSource(source),
+	)
 	if err != nil {
 		return err
 	}
 
-	identifier := strings.Split(table, ".")
-	rowsRead, err := tx.CopyFrom(job.ctx, identifier, columnNames, rows)
-	if err != nil {
-		return err
-	}
-
-	err = tx.Commit(job.ctx)
-	if err != nil {
-		return err
-	}
 	job.updatedRows += uint32(rowsRead)
-	tx = nil
 	return nil
 }
 
-func getKeyHash(ctx context.Context, conn *pgx.Conn, table string, primaryKeys []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string) (string, error) {
+// sourceKeyExpressions returns the expressions used for ordering and comparing source keys
+// while scanning for deletions. SQLite and file export targets compare text keys byte by byte,
+// so text keys are compared in the "C" collation for them. Other targets use the key columns.
+func (job *Job) sourceKeyExpressions(table string, primaryKeys []string) []string {
+	if job.sink == nil {
+		return primaryKeys
+	}
+	expressions := make([]string, len(primaryKeys))
+	for i, key := range primaryKeys {
+		expressions[i] = key
+		if isTextType(job.columnTypes[table][key]) {
+			expressions[i] = key + ` collate "C"`
+		}
+	}
+	return expressions
+}
+
+// getKeyHash calculates a hash of the hashed columns of all rows in the key range,
+// and returns it with the number of hashed rows and their size in bytes.
+// The hashed columns are normally the primary keys, but can include other
+// columns to detect content changes.
+func getKeyHash(ctx context.Context, conn dbConn, table string, primaryKeys []string, hashedColumns []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string) (string, uint64, uint64, error) {
 	var extraWhereClause string
 	if len(where) > 0 {
 		extraWhereClause = "and " + where
 	}
 
 	keyList := strings.Join(primaryKeys, ",")
+	hashedList := strings.Join(hashedColumns, ",")
 
 	whereClause, queryParameters := whereClauseFromKeyRange(primaryKeys, startKey, endKey)
 
 	q := fmt.Sprintf(`--sql 
 	select
-		coalesce(md5(array_agg(id)::varchar), '') as hash
+		coalesce(md5(array_agg(id)::varchar), '') as hash,
+		count(*) as row_count,
+		coalesce(sum(octet_length(id)), 0)::bigint as byte_count
 	from (
 		select
-			(%[1]s)::varchar as id
+			(%[5]s)::varchar as id
 		from
 			%[2]s
 		where
@@ -258,17 +335,49 @@ func getKeyHash(ctx context.Context, conn *pgx.Conn, table string, primaryKeys [
 		order by
 			%[1]s
 	) as t
-	;`, keyList, table, whereClause, extraWhereClause)
+	;`, keyList, table, whereClause, extraWhereClause, hashedList)
 	row := conn.QueryRow(ctx, q, queryParameters...)
 	var hash string
-	err := row.Scan(&hash)
+	var rows, bytes int64
+	err := row.Scan(&hash, &rows, &bytes)
 	if err != nil {
-		return "", err
+		return "", 0, 0, err
+	}
+	return hash, uint64(rows), uint64(bytes), nil
+}
+
+// getHashedColumns returns the columns to hash while scanning for changes.
+// When verifying content, all columns except the excluded ones are hashed,
+// otherwise only the primary keys.
+func (job *Job) getHashedColumns(table string, primaryKeys []string) []string {
+	if !job.cfg.VerifyContent {
+		return primaryKeys
+	}
+
+	excluded := make(map[string]bool)
+	for _, column := range job.cfg.tableSettings(table).VerifyExcludeColumns {
+		excluded[column] = true
 	}
-	return hash, nil
+	// Transformed columns always differ from the source
+	for column := range job.cfg.tableSettings(table).Transforms {
+		excluded[column] = true
+	}
+	for _, key := range primaryKeys {
+		excluded[key] = true
+	}
+
+	var contentColumns []string
+	for column := range job.columnTypes[table] {
+		if !excluded[column] {
+			contentColumns = append(contentColumns, column)
+		}
+	}
+	sort.Strings(contentColumns)
+
+	return append(append([]string{}, primaryKeys...), contentColumns...)
 }
 
-func getPrimaryKeyRange(ctx context.Context, conn *pgx.Conn, table string, primaryKeys []string, where string) (primaryKeyRange, error) {
+func getPrimaryKeyRange(ctx context.Context, conn dbConn, table string, primaryKeys []string, where string) (primaryKeyRange, error) {
 	var whereClause string
 	if len(where) > 0 {
 		whereClause = "where " + where
@@ -322,6 +431,71 @@ func getPrimaryKeyRange(ctx context.Context, conn *pgx.Conn, table string, prima
 	return result, nil
 }
 
+// getPartitionBounds samples the primary keys of a table to find keys splitting the
+// key range into "partitions" parts of roughly equal size.
+// The returned keys are ordered, unique and after the range start.
+func getPartitionBounds(ctx context.Context, conn dbConn, table string, primaryKeys []string, keyRange primaryKeyRange, partitions int, where string) (PrimaryKeySetSlice, error) {
+	var result PrimaryKeySetSlice
+
+	var whereClause string
+	if len(where) > 0 {
+		whereClause = "where " + where
+	}
+
+	const samplesPerPartition = 100
+	percentage := math.Min(100, 100*float64(partitions*samplesPerPartition)/math.Max(1, float64(keyRange.count)))
+
+	keyList := strings.Join(primaryKeys, ",")
+
+	q := fmt.Sprintf(`--sql
+	select
+		%[2]s
+	from
+		%[1]s tablesample system (%[3]f)
+	%[4]s
+	order by
+		%[2]s
+	;`, table, keyList, percentage, whereClause)
+
+	rows, err := conn.Query(ctx, q)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	var samples PrimaryKeySetSlice
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return result, err
+		}
+		sample := make(PrimaryKeySet, len(primaryKeys))
+		for i := range sample {
+			sample[i].value = values[i]
+		}
+		samples = append(samples, sample)
+	}
+	if rows.Err() != nil {
+		return result, rows.Err()
+	}
+
+	lastBound := keyRange.min
+	for i := 1; i < partitions; i++ {
+		index := i * len(samples) / partitions
+		if index >= len(samples) {
+			break
+		}
+		bound := samples[index]
+		if bound.Equals(lastBound) || bound.Equals(keyRange.min) {
+			continue
+		}
+		result = append(result, bound)
+		lastBound = bound
+	}
+
+	return result, nil
+}
+
 func integerValue(unknown interface{}) (result uint32, err error) {
 	str := fmt.Sprintf("%v", unknown)
 	_, err = fmt.Sscanf(str, "%d", &result)
@@ -331,27 +505,16 @@ func integerValue(unknown interface{}) (result uint32, err error) {
 // whereClauseFromKeyRange creates a string with "where" filters, and corresponding list of query parameters
 // from a set of primary key names and their limit values.
 //
-// The returned filter represents the closed interval [startKey, endKey].
+// The returned filter represents the closed interval [startKey, endKey], using the same
+// lexicographic ordering of multi-column keys as "order by" on the key columns.
 // We use a closed interval and accept overlapping endpoints, since we cannot easily increment
 // multi-column string-valued keys.
 func whereClauseFromKeyRange(primaryKeys []string, startKey, endKey PrimaryKeySet) (string, []interface{}) {
-	var startFiltering []string
-	var queryParameters []interface{}
-	for i, keyValue := range startKey {
-		startFiltering = append(startFiltering, fmt.Sprintf("%s >= $%d", primaryKeys[i], i+1))
-		queryParameters = append(queryParameters, keyValue.value)
-	}
-
-	var endFiltering []string
+	queryParameters := append(startKey.Values(), endKey.Values()...)
 
-	parameterOffset := 1 + len(queryParameters)
-	for i, keyValue := range endKey {
-		endFiltering = append(endFiltering, fmt.Sprintf("%s <= $%d", primaryKeys[i], i+parameterOffset))
-		queryParameters = append(queryParameters, keyValue.value)
-	}
-	whereClause := strings.Join(startFiltering, " and ")
+	whereClause := tupleComparison(primaryKeys, ">=", 1)
 	whereClause += " and "
-	whereClause += strings.Join(endFiltering, " and ")
+	whereClause += tupleComparison(primaryKeys, "<=", 1+len(startKey))
 
 	return whereClause, queryParameters
 }
@@ -0,0 +1,197 @@
+package sslr
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+var compositeKeys = []string{"a", "b"}
+
+// createCompositeKeyTable creates a temporary table with all combinations of
+// a in 1..5 and b in x, y, z, interleaving the two key columns.
+func createCompositeKeyTable(t *testing.T, conn *pgx.Conn, table string) {
+	t.Helper()
+	ctx := context.Background()
+
+	_, err := conn.Exec(ctx, fmt.Sprintf(`--sql
+	create temporary table %[1]s (a int, b text, primary key (a, b));
+	insert into %[1]s select a, b from generate_series(1, 5) a, unnest(array['x', 'y', 'z']) b;
+	`, table))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func compositeKey(a int32, b string) PrimaryKeySet {
+	return PrimaryKeySet{{value: a}, {value: b}}
+}
+
+func TestCompositeKeyRange(t *testing.T) {
+	conn := testConnection(t)
+	ctx := context.Background()
+	createCompositeKeyTable(t, conn, "composite_range")
+
+	// Comparing the columns one by one would match no rows at all
+	whereClause, parameters := whereClauseFromKeyRange(compositeKeys, compositeKey(1, "y"), compositeKey(3, "x"))
+	rows, err := conn.Query(ctx, "select a::text || b from composite_range where "+whereClause+" order by a, b", parameters...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if rows.Err() != nil {
+		t.Fatal(rows.Err())
+	}
+
+	expected := fmt.Sprint([]string{"1y", "1z", "2x", "2y", "2z", "3x"})
+	if fmt.Sprint(keys) != expected {
+		t.Errorf("keys in range = %v, expected %v", keys, expected)
+	}
+
+	_, hashedRows, hashedBytes, err := getKeyHash(ctx, conn, "composite_range", compositeKeys, compositeKeys, compositeKey(1, "y"), compositeKey(3, "x"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashedRows != 6 || hashedBytes == 0 {
+		t.Errorf("hashed %v rows and %v bytes, expected 6 rows", hashedRows, hashedBytes)
+	}
+}
+
+func TestCompositeKeyAtOffset(t *testing.T) {
+	conn := testConnection(t)
+	ctx := context.Background()
+	createCompositeKeyTable(t, conn, "composite_offset")
+
+	tests := []struct {
+		start    PrimaryKeySet
+		limit    PrimaryKeySet
+		offset   uint32
+		expected PrimaryKeySet
+	}{
+		{compositeKey(1, "x"), nil, 1, compositeKey(1, "x")},
+		{compositeKey(1, "x"), nil, 4, compositeKey(2, "x")},
+		{compositeKey(1, "z"), nil, 3, compositeKey(2, "y")},
+		{compositeKey(1, "y"), compositeKey(1, "z"), 10, compositeKey(1, "z")},
+		{compositeKey(4, "y"), nil, 10, compositeKey(5, "z")},
+	}
+
+	for _, test := range tests {
+		key, err := getKeyAtOffset(ctx, conn, "composite_offset", compositeKeys, test.start, test.limit, test.offset, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !key.Equals(test.expected) {
+			t.Errorf("key %v rows from %v = %v, expected %v", test.offset, test.start, key, test.expected)
+		}
+	}
+}
+
+// TestCompositeKeyDeletes walks the source table in chunks the same way as
+// syncDeletedRowPartition, and checks that every row deleted from the
+// source falls within a chunk with differing hashes.
+func TestCompositeKeyDeletes(t *testing.T) {
+	conn := testConnection(t)
+	ctx := context.Background()
+	createCompositeKeyTable(t, conn, "composite_source")
+	createCompositeKeyTable(t, conn, "composite_target")
+
+	deleted := []PrimaryKeySet{
+		compositeKey(1, "z"),
+		compositeKey(2, "x"),
+		compositeKey(3, "y"),
+		compositeKey(4, "z"),
+		compositeKey(5, "x"),
+	}
+	for _, key := range deleted {
+		_, err := conn.Exec(ctx, "delete from composite_source where "+tupleComparison(compositeKeys, "=", 1), key.Values()...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keyRange, err := getPrimaryKeyRange(ctx, conn, "composite_source", compositeKeys, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	detected := map[string]bool{}
+	startKey := keyRange.min
+	for {
+		endKey, err := getKeyAtOffset(ctx, conn, "composite_source", compositeKeys, startKey, nil, 2, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sourceHash, _, _, err := getKeyHash(ctx, conn, "composite_source", compositeKeys, compositeKeys, startKey, endKey, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		targetHash, _, _, err := getKeyHash(ctx, conn, "composite_target", compositeKeys, compositeKeys, startKey, endKey, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sourceHash != targetHash {
+			for _, key := range deleted {
+				if keyInRange(t, conn, key, startKey, endKey) {
+					detected[fmt.Sprint(key)] = true
+				}
+			}
+		}
+		if endKey.Equals(startKey) {
+			break
+		}
+		startKey = endKey
+	}
+
+	for _, key := range deleted {
+		if !detected[fmt.Sprint(key)] {
+			t.Errorf("deleted row %v was not detected", key)
+		}
+	}
+}
+
+func keyInRange(t *testing.T, conn *pgx.Conn, key, startKey, endKey PrimaryKeySet) bool {
+	t.Helper()
+	whereClause, parameters := whereClauseFromKeyRange(compositeKeys, startKey, endKey)
+	parameters = append(parameters, key.Values()...)
+	var inRange bool
+	err := conn.QueryRow(context.Background(),
+		"select exists (select 1 from composite_target where "+whereClause+" and "+tupleComparison(compositeKeys, "=", 5)+")",
+		parameters...,
+	).Scan(&inRange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inRange
+}
+
+func TestSourceKeyExpressions(t *testing.T) {
+	job := Job{columnTypes: map[string]map[string]columnType{
+		"public.t": {
+			"a": {name: "integer", oid: pgtype.Int4OID},
+			"b": {name: "text", oid: pgtype.TextOID},
+		},
+	}}
+
+	keys := fmt.Sprint(job.sourceKeyExpressions("public.t", compositeKeys))
+	if keys != "[a b]" {
+		t.Errorf("expected key columns for Postgres targets, got %v", keys)
+	}
+
+	job.sink = &sqliteSink{}
+	keys = fmt.Sprint(job.sourceKeyExpressions("public.t", compositeKeys))
+	if keys != `[a b collate "C"]` {
+		t.Errorf("expected text keys in the C collation for SQLite targets, got %v", keys)
+	}
+}
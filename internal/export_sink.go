@@ -0,0 +1,567 @@
+package sslr
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/logger"
+	"github.com/jackc/pgx/v4"
+)
+
+// exportPrefix marks target connections to export directories, like "export:extracts"
+const exportPrefix = "export:"
+
+// Export file formats
+const (
+	exportCSV     = "csv"
+	exportJSONL   = "jsonl"
+	exportParquet = "parquet"
+)
+
+// exportIndexFile is the SQLite file in the export directory keeping table state
+// and the keys of exported rows, used for finding deleted rows
+const exportIndexFile = "sslr_index.db"
+
+const exportManifestFile = "manifest.json"
+
+// Run directories are named by run start time, in UTC
+const exportRunFormat = "20060102T150405.000Z"
+
+// Kinds of export files
+const (
+	// A full copy of the table, possibly split into several files
+	exportFull = "full"
+	// A batch of changed rows
+	exportChanges = "changes"
+)
+
+// Change operations, in the "sslr_op" column of change files
+const (
+	exportUpsert = "upsert"
+	exportDelete = "delete"
+)
+
+// exportChangeColumns are added before the table columns in change files,
+// holding the operation and the source transaction id of changed rows
+var exportChangeColumns = []string{"sslr_op", "sslr_xmin"}
+
+func isExportConnection(connection string) bool {
+	return strings.HasPrefix(connection, exportPrefix)
+}
+
+// exportSink writes full table copies and batches of changed rows to files.
+// Each run writes to a new directory, with a manifest listing the written files.
+//
+// Table state and the keys of all exported rows are kept in a SQLite index,
+// which is used for finding deleted rows, like the target table of other sinks.
+type exportSink struct {
+	index    *sqliteSink
+	runDir   string
+	files    int
+	manifest exportManifest
+}
+
+// Run statuses, in the run manifest
+const (
+	exportRunning  = "running"
+	exportFinished = "finished"
+	exportFailed   = "failed"
+)
+
+// exportManifest describes the files written in a run.
+// Finished is only set for runs that succeeded.
+type exportManifest struct {
+	Started  time.Time      `json:"started"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	Status   string         `json:"status"`
+	Error    string         `json:"error,omitempty"`
+	Format   string         `json:"format"`
+	Files    []exportedFile `json:"files"`
+}
+
+type exportedFile struct {
+	Name  string `json:"name"`
+	Table string `json:"table"`
+	Kind  string `json:"kind"`
+	Rows  int64  `json:"rows"`
+}
+
+func openExportSink(ctx context.Context, connection string, format string, stateTable string) (*exportSink, error) {
+	dir := strings.TrimPrefix(connection, exportPrefix)
+	started := time.Now().UTC()
+	runDir := filepath.Join(dir, "runs", started.Format(exportRunFormat))
+
+	err := os.MkdirAll(runDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create export directory: %w", err)
+	}
+
+	index, err := openSQLiteSink(ctx, sqlitePrefix+filepath.Join(dir, exportIndexFile), stateTable)
+	if err != nil {
+		return nil, err
+	}
+
+	return &exportSink{
+		index:  index,
+		runDir: runDir,
+		manifest: exportManifest{
+			Started: started,
+			Status:  exportRunning,
+			Format:  format,
+			Files:   []exportedFile{},
+		},
+	}, nil
+}
+
+func (s *exportSink) setupState(ctx context.Context) error {
+	return s.index.setupState(ctx)
+}
+
+func (s *exportSink) loadState(ctx context.Context, key string) (tableState, error) {
+	return s.index.loadState(ctx, key)
+}
+
+func (s *exportSink) storeState(ctx context.Context, key string, state tableState) error {
+	return s.index.storeState(ctx, key, state)
+}
+
+func (s *exportSink) tableExists(ctx context.Context, table string) (bool, error) {
+	return s.index.tableExists(ctx, table)
+}
+
+func (s *exportSink) tableSchema(ctx context.Context, table string) (string, error) {
+	return s.index.tableSchema(ctx, table)
+}
+
+func (s *exportSink) createTable(ctx context.Context, table string, definition tableDefinition) error {
+	return s.index.createTable(ctx, table, definition)
+}
+
+func (s *exportSink) recreateTable(ctx context.Context, table string, definition tableDefinition) error {
+	return s.index.recreateTable(ctx, table, definition)
+}
+
+func (s *exportSink) createIndices(ctx context.Context, table string, indices []tableIndex) error {
+	return s.index.createIndices(ctx, table, indices)
+}
+
+func (s *exportSink) tableLength(ctx context.Context, table string, where string) (uint64, error) {
+	return s.index.tableLength(ctx, table, where)
+}
+
+// keyHash hashes the keys in the index. Only key columns can be hashed,
+// since the index does not keep row contents.
+func (s *exportSink) keyHash(ctx context.Context, table string, primaryKeys []string, hashedColumns []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string) (string, error) {
+	return s.index.keyHash(ctx, table, primaryKeys, hashedColumns, startKey, endKey, where)
+}
+
+func (s *exportSink) sourceKeyHash(ctx context.Context, source dbConn, throttle *throttledOperation, table string, primaryKeys []string, hashedColumns []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string) (string, error) {
+	return s.index.sourceKeyHash(ctx, source, throttle, table, primaryKeys, hashedColumns, startKey, endKey, where)
+}
+
+// applyChunk exports the rows as upserts
+func (s *exportSink) applyChunk(ctx context.Context, table string, primaryKeys []string, keyTypes []columnType, columns []string, rows [][]interface{}, xmins []uint64, strategy string) error {
+	_, types, _, err := s.index.tableColumns(ctx, table)
+	if err != nil {
+		return err
+	}
+
+	file, err := s.createFile(table, exportChanges, columns, types)
+	if err != nil {
+		return err
+	}
+
+	keyIndices := keyColumnIndices(primaryKeys, columns)
+	keyRows := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		err = file.write(append([]interface{}{exportUpsert, xmins[i]}, row...))
+		if err != nil {
+			file.discard()
+			return err
+		}
+		keyRows[i] = selectColumns(row, keyIndices)
+	}
+
+	return s.updateIndex(ctx, file, func(tx *sql.Tx) error {
+		_, err := sqliteInsert(ctx, tx, table, primaryKeys, pgx.CopyFromRows(keyRows))
+		return err
+	})
+}
+
+// replaceRange exports the rows in the key range as upserts, and indexed
+// rows missing from the range as deletes
+func (s *exportSink) replaceRange(ctx context.Context, table string, primaryKeys []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string, columns []string, rows pgx.CopyFromSource) (int64, error) {
+	_, types, _, err := s.index.tableColumns(ctx, table)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := s.createFile(table, exportChanges, columns, types)
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	err = s.updateIndex(ctx, file, func(tx *sql.Tx) error {
+		whereClause, queryParameters := sqliteKeyRange(primaryKeys, types, startKey, endKey)
+		indexTable := sqliteIdentifier(sqliteTableName(table))
+
+		unseen, err := indexedKeys(ctx, tx, indexTable, primaryKeys, whereClause, queryParameters)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("delete from %s where %s", indexTable, whereClause), queryParameters...)
+		if err != nil {
+			return err
+		}
+
+		keyIndices := keyColumnIndices(primaryKeys, columns)
+		source := &exportingSource{
+			CopyFromSource: rows,
+			file:           file,
+			prefix:         []interface{}{exportUpsert, nil},
+			keyIndices:     keyIndices,
+			unseen:         unseen,
+		}
+		written, err = sqliteInsert(ctx, tx, table, primaryKeys, source)
+		if err != nil {
+			return err
+		}
+
+		for _, keys := range unseen {
+			row := make([]interface{}, len(columns))
+			for i, index := range keyIndices {
+				row[index] = keys[i]
+			}
+			err = file.write(append([]interface{}{exportDelete, nil}, row...))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+// replaceTable exports a full copy of the table
+func (s *exportSink) replaceTable(ctx context.Context, table string, where string, copy func(target rowCopier) error) error {
+	_, types, keys, err := s.index.tableColumns(ctx, table)
+	if err != nil {
+		return err
+	}
+
+	return s.updateIndex(ctx, nil, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("delete from %s", sqliteIdentifier(sqliteTableName(table))))
+		if err != nil {
+			return fmt.Errorf("failed to delete old data: %w", err)
+		}
+		return copy(exportCopier{
+			sink:  s,
+			tx:    tx,
+			types: types,
+			keys:  keys,
+		})
+	})
+}
+
+// close writes the final run manifest, with the run status
+func (s *exportSink) close(ctx context.Context, runErr error) {
+	if runErr == nil {
+		finished := time.Now().UTC()
+		s.manifest.Finished = &finished
+		s.manifest.Status = exportFinished
+	} else {
+		s.manifest.Status = exportFailed
+		s.manifest.Error = runErr.Error()
+	}
+	err := s.writeManifest()
+	if err != nil {
+		logger.Error.Printf("Failed to write export manifest: %v", err)
+	}
+	s.index.close(ctx, runErr)
+}
+
+// updateIndex calls "update" in an index transaction. The export file is finished
+// before the index is committed, so that rows are exported at least once.
+// The file is removed if the update fails.
+func (s *exportSink) updateIndex(ctx context.Context, file *exportFile, update func(tx *sql.Tx) error) error {
+	tx, err := s.index.db.BeginTx(ctx, nil)
+	if err != nil {
+		if file != nil {
+			file.discard()
+		}
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = update(tx)
+	if err != nil {
+		if file != nil {
+			file.discard()
+		}
+		return err
+	}
+
+	if file != nil {
+		err = s.finishFile(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	tx = nil
+	return nil
+}
+
+// createFile creates the next export file of the run. Change files
+// start with the change columns. Column types are SQLite index types.
+func (s *exportSink) createFile(table string, kind string, columns []string, types map[string]string) (*exportFile, error) {
+	var columnTypes []string
+	if kind == exportChanges {
+		columns = append(append([]string{}, exportChangeColumns...), columns...)
+		columnTypes = []string{"text", "integer"}
+	}
+	for _, column := range columns[len(columnTypes):] {
+		columnTypes = append(columnTypes, types[column])
+	}
+
+	s.files++
+	name := fmt.Sprintf("%05d-%s-%s.%s", s.files, table, kind, s.manifest.Format)
+	path := filepath.Join(s.runDir, name)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create export file: %w", err)
+	}
+	buffer := bufio.NewWriter(file)
+
+	writer, err := newExportWriter(s.manifest.Format, buffer, columns, columnTypes)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	return &exportFile{
+		path:   path,
+		file:   file,
+		buffer: buffer,
+		writer: writer,
+		info: exportedFile{
+			Name:  name,
+			Table: table,
+			Kind:  kind,
+		},
+	}, nil
+}
+
+// finishFile closes the file and adds it to the run manifest. Empty files are removed.
+func (s *exportSink) finishFile(file *exportFile) error {
+	if file.info.Rows == 0 {
+		file.discard()
+		return nil
+	}
+
+	err := file.close()
+	if err != nil {
+		file.discard()
+		return fmt.Errorf("failed to write export file: %w", err)
+	}
+
+	s.manifest.Files = append(s.manifest.Files, file.info)
+	return s.writeManifest()
+}
+
+// writeManifest replaces the run manifest, which is kept up to date
+// while running, in case the run is interrupted
+func (s *exportSink) writeManifest() error {
+	data, err := json.MarshalIndent(s.manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.runDir, exportManifestFile)
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// exportFile is an export file being written
+type exportFile struct {
+	path   string
+	file   *os.File
+	buffer *bufio.Writer
+	writer exportWriter
+	info   exportedFile
+}
+
+func (f *exportFile) write(row []interface{}) error {
+	err := f.writer.write(row)
+	if err != nil {
+		return fmt.Errorf("failed to write export file: %w", err)
+	}
+	f.info.Rows++
+	return nil
+}
+
+func (f *exportFile) close() error {
+	err := f.writer.close()
+	if err != nil {
+		f.file.Close()
+		return err
+	}
+	err = f.buffer.Flush()
+	if err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// discard closes and removes the file
+func (f *exportFile) discard() {
+	f.file.Close()
+	os.Remove(f.path)
+}
+
+// exportCopier implements rowCopier, writing each copied batch
+// to a full copy file, and the row keys to the index
+type exportCopier struct {
+	sink  *exportSink
+	tx    *sql.Tx
+	types map[string]string
+	keys  []string
+}
+
+func (c exportCopier) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	table := strings.Join(tableName, ".")
+
+	file, err := c.sink.createFile(table, exportFull, columnNames, c.types)
+	if err != nil {
+		return 0, err
+	}
+
+	source := &exportingSource{
+		CopyFromSource: rowSrc,
+		file:           file,
+		keyIndices:     keyColumnIndices(c.keys, columnNames),
+	}
+
+	var written int64
+	if len(c.keys) == 0 {
+		for source.Next() {
+			_, err = source.Values()
+			if err != nil {
+				break
+			}
+			written++
+		}
+		if err == nil {
+			err = source.Err()
+		}
+	} else {
+		written, err = sqliteInsert(ctx, c.tx, table, c.keys, source)
+	}
+	if err != nil {
+		file.discard()
+		return 0, err
+	}
+
+	return written, c.sink.finishFile(file)
+}
+
+// exportingSource writes rows to an export file as they are read,
+// returning only the key columns, for updating the index
+type exportingSource struct {
+	pgx.CopyFromSource
+	file *exportFile
+	// Values written before the row values
+	prefix     []interface{}
+	keyIndices []int
+	// When set, keys of written rows are removed, see indexedKeys
+	unseen map[string][]interface{}
+}
+
+func (s *exportingSource) Values() ([]interface{}, error) {
+	values, err := s.CopyFromSource.Values()
+	if err != nil {
+		return nil, err
+	}
+
+	row := make([]interface{}, 0, len(s.prefix)+len(values))
+	row = append(row, s.prefix...)
+	err = s.file.write(append(row, values...))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := selectColumns(values, s.keyIndices)
+	if s.unseen != nil {
+		delete(s.unseen, keyText(keys))
+	}
+	return keys, nil
+}
+
+// indexedKeys returns the keys in the index table matching the where clause, by key text
+func indexedKeys(ctx context.Context, tx *sql.Tx, indexTable string, primaryKeys []string, whereClause string, queryParameters []interface{}) (map[string][]interface{}, error) {
+	q := fmt.Sprintf("select %s from %s where %s", sqliteIdentifiers(primaryKeys), indexTable, whereClause)
+	rows, err := tx.QueryContext(ctx, q, queryParameters...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[string][]interface{})
+	for rows.Next() {
+		values := make([]interface{}, len(primaryKeys))
+		pointers := make([]interface{}, len(primaryKeys))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+		keys[keyText(values)] = values
+	}
+	return keys, rows.Err()
+}
+
+// keyText returns the key values as text, as stored in the index
+func keyText(keys []interface{}) string {
+	text := make([]string, len(keys))
+	for i, key := range keys {
+		text[i] = fmt.Sprintf("%v", sqliteValue(key))
+	}
+	return strings.Join(text, "\x00")
+}
+
+func selectColumns(row []interface{}, indices []int) []interface{} {
+	selected := make([]interface{}, len(indices))
+	for i, index := range indices {
+		selected[i] = row[index]
+	}
+	return selected
+}
@@ -0,0 +1,122 @@
+package sslr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+func testExportSink(t *testing.T) *exportSink {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sslr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	sink, err := openExportSink(context.Background(), exportPrefix+dir, exportJSONL, "__sslr_state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.setupState(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func readManifest(t *testing.T, sink *exportSink) exportManifest {
+	t.Helper()
+	var manifest exportManifest
+	data, err := ioutil.ReadFile(filepath.Join(sink.runDir, exportManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestExportReplaceRangeDeletes(t *testing.T) {
+	ctx := context.Background()
+	sink := testExportSink(t)
+	defer sink.close(ctx, nil)
+
+	err := sink.createTable(ctx, "public.keys", tableDefinition{
+		columns:     []string{"id"},
+		columnTypes: map[string]columnType{"id": {name: "text", oid: pgtype.TextOID}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.createIndices(ctx, "public.keys", []tableIndex{{indexName: "keys_pkey", columns: []string{"id"}, primary: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := [][]interface{}{{"A"}, {"B"}, {"Z"}, {"a"}, {"é"}}
+	err = sink.applyChunk(ctx, "public.keys", []string{"id"}, nil, []string{"id"}, keys, make([]uint64, len(keys)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// In byte order, "a" and "é" are after the range
+	_, err = sink.replaceRange(
+		ctx, "public.keys", []string{"id"}, PrimaryKeySet{{"B"}}, PrimaryKeySet{{"Z"}}, "",
+		[]string{"id"}, pgx.CopyFromRows([][]interface{}{{"B"}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := readManifest(t, sink).Files
+	if len(files) != 2 {
+		t.Fatalf("expected two change files, got %v", files)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(sink.runDir, files[1].Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deleted []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var row map[string]interface{}
+		err = json.Unmarshal([]byte(line), &row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row["sslr_op"] == exportDelete {
+			deleted = append(deleted, row["id"].(string))
+		}
+	}
+	if len(deleted) != 1 || deleted[0] != "Z" {
+		t.Errorf("deleted keys = %v, expected [Z]", deleted)
+	}
+}
+
+func TestExportManifestStatus(t *testing.T) {
+	ctx := context.Background()
+
+	sink := testExportSink(t)
+	sink.close(ctx, nil)
+	manifest := readManifest(t, sink)
+	if manifest.Status != exportFinished || manifest.Finished == nil || manifest.Error != "" {
+		t.Errorf("unexpected manifest of finished run: %+v", manifest)
+	}
+
+	sink = testExportSink(t)
+	sink.close(ctx, errors.New("connection lost"))
+	manifest = readManifest(t, sink)
+	if manifest.Status != exportFailed || manifest.Finished != nil || manifest.Error != "connection lost" {
+		t.Errorf("unexpected manifest of failed run: %+v", manifest)
+	}
+}
@@ -0,0 +1,218 @@
+package sslr
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// exportWriter writes rows to an export file
+type exportWriter interface {
+	write(row []interface{}) error
+	close() error
+}
+
+// newExportWriter creates a writer for the given export format.
+// Column types are SQLite index types, see sqliteColumnType.
+func newExportWriter(format string, w io.Writer, columns []string, types []string) (exportWriter, error) {
+	switch format {
+	case exportCSV:
+		return newCSVExportWriter(w, columns)
+	case exportJSONL:
+		return newJSONLExportWriter(w, columns), nil
+	case exportParquet:
+		return newParquetExportWriter(w, columns, types)
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// exportValue converts a value decoded by pgx to a plain value for export.
+// Timestamps are exported in RFC 3339 format and binary values in Postgres hex format.
+func exportValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case bool:
+		return value
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return `\x` + hex.EncodeToString(value)
+	default:
+		return sqliteValue(value)
+	}
+}
+
+func exportText(v interface{}) string {
+	value := exportValue(v)
+	if text, ok := value.(string); ok {
+		return text
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// csvExportWriter writes a header row with the column names, followed by the rows.
+// Null values are written as empty fields.
+type csvExportWriter struct {
+	writer *csv.Writer
+	record []string
+}
+
+func newCSVExportWriter(w io.Writer, columns []string) (exportWriter, error) {
+	csvWriter := csv.NewWriter(w)
+	err := csvWriter.Write(columns)
+	if err != nil {
+		return nil, err
+	}
+	return &csvExportWriter{
+		writer: csvWriter,
+		record: make([]string, len(columns)),
+	}, nil
+}
+
+func (c *csvExportWriter) write(row []interface{}) error {
+	for i, value := range row {
+		c.record[i] = ""
+		if value != nil {
+			c.record[i] = exportText(value)
+		}
+	}
+	return c.writer.Write(c.record)
+}
+
+func (c *csvExportWriter) close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+// jsonlExportWriter writes each row as a JSON object on a separate line.
+// JSON column values are written as nested JSON.
+type jsonlExportWriter struct {
+	writer io.Writer
+	keys   [][]byte
+}
+
+func newJSONLExportWriter(w io.Writer, columns []string) exportWriter {
+	keys := make([][]byte, len(columns))
+	for i, column := range columns {
+		keys[i], _ = json.Marshal(column)
+	}
+	return &jsonlExportWriter{
+		writer: w,
+		keys:   keys,
+	}
+}
+
+func (j *jsonlExportWriter) write(row []interface{}) error {
+	line := []byte{'{'}
+	for i, value := range row {
+		if i > 0 {
+			line = append(line, ',')
+		}
+		line = append(line, j.keys[i]...)
+		line = append(line, ':')
+
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+		default:
+			value = exportValue(value)
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		line = append(line, encoded...)
+	}
+	line = append(line, '}', '\n')
+
+	_, err := j.writer.Write(line)
+	return err
+}
+
+func (j *jsonlExportWriter) close() error {
+	return nil
+}
+
+// parquetExportWriter writes rows to a Parquet file, with all columns optional.
+// Integer columns are written as INT64, floating point columns as DOUBLE,
+// binary columns as BYTE_ARRAY and all other columns as UTF8 strings.
+type parquetExportWriter struct {
+	writer *writer.CSVWriter
+	types  []string
+}
+
+func newParquetExportWriter(w io.Writer, columns []string, types []string) (exportWriter, error) {
+	metadata := make([]string, len(columns))
+	for i, column := range columns {
+		var parquetType string
+		switch types[i] {
+		case "integer":
+			parquetType = "type=INT64"
+		case "real":
+			parquetType = "type=DOUBLE"
+		case "blob":
+			parquetType = "type=BYTE_ARRAY"
+		default:
+			parquetType = "type=UTF8"
+		}
+		// Column metadata is parsed from comma separated key=value pairs
+		if strings.ContainsAny(column, ",=") {
+			return nil, fmt.Errorf("cannot export column %q to Parquet", column)
+		}
+		metadata[i] = fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", column, parquetType)
+	}
+
+	parquetWriter, err := writer.NewCSVWriterFromWriter(metadata, w, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetExportWriter{
+		writer: parquetWriter,
+		types:  types,
+	}, nil
+}
+
+func (p *parquetExportWriter) write(row []interface{}) error {
+	// Rows are buffered by the Parquet writer until the row group is full
+	record := make([]interface{}, len(row))
+	for i, value := range row {
+		if value == nil {
+			continue
+		}
+		switch p.types[i] {
+		case "integer":
+			integer, ok := sqliteValue(value).(int64)
+			if !ok {
+				return fmt.Errorf("cannot export %v as an integer", value)
+			}
+			record[i] = integer
+		case "real":
+			switch converted := sqliteValue(value).(type) {
+			case float64:
+				record[i] = converted
+			case int64:
+				record[i] = float64(converted)
+			default:
+				return fmt.Errorf("cannot export %v as a floating point number", value)
+			}
+		case "blob":
+			if bytes, ok := value.([]byte); ok {
+				record[i] = string(bytes)
+			} else {
+				record[i] = exportText(value)
+			}
+		default:
+			record[i] = exportText(value)
+		}
+	}
+	return p.writer.Write(record)
+}
+
+func (p *parquetExportWriter) close() error {
+	return p.writer.WriteStop()
+}
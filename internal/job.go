@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/erkkah/letarette/pkg/logger"
@@ -27,10 +28,25 @@ type Job struct {
 	cfg              Config
 	primaryKeys      map[string][]string
 	columns          map[string][]string
+	columnTypes      map[string]map[string]columnType
+	schemas          map[string]string
+	indices          map[string][]tableIndex
 	forceSync        map[string]bool
 	validationStatus map[string]ValidationStatus
 	source           *pgx.Conn
-	target           *pgx.Conn
+	target           dbConn
+	targetConn       *pgx.Conn
+	atomicTx         pgx.Tx
+	sink             sink
+	throttleBudget   *throttleBudget
+	snapshotID       string
+	schedule         schedule
+	tableSchedules   map[string]schedule
+	lastSynced       map[string]time.Time
+	sourceName       string
+	sourceJobs       []*Job
+	targetName       string
+	targets          []*jobTarget
 	start            time.Time
 	updatedRows      uint32
 }
@@ -42,27 +58,128 @@ func NewJob(ctx context.Context, config Config) (*Job, error) {
 		cfg:              config,
 		primaryKeys:      make(map[string][]string),
 		columns:          make(map[string][]string),
+		columnTypes:      make(map[string]map[string]columnType),
+		schemas:          make(map[string]string),
+		indices:          make(map[string][]tableIndex),
 		forceSync:        make(map[string]bool),
 		validationStatus: make(map[string]ValidationStatus),
+		tableSchedules:   make(map[string]schedule),
+		lastSynced:       make(map[string]time.Time),
 	}
+
+	var err error
+	job.schedule, err = config.Schedule.parse()
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range config.allTables() {
+		job.tableSchedules[table], err = config.tableSettings(table).Schedule.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, target := range config.Targets {
+		job.targets = append(job.targets, &jobTarget{
+			name:             target.Name,
+			connection:       target.Connection,
+			validationStatus: make(map[string]ValidationStatus),
+			forceSync:        make(map[string]bool),
+		})
+	}
+
+	for _, source := range config.Sources {
+		sourceConfig := config
+		sourceConfig.SourceConnection = source.Connection
+		sourceConfig.Sources = nil
+		sourceJob, err := NewJob(ctx, sourceConfig)
+		if err != nil {
+			return nil, err
+		}
+		sourceJob.sourceName = source.Name
+		job.sourceJobs = append(job.sourceJobs, sourceJob)
+	}
+
 	return &job, nil
 }
 
 // Run performs a full sync operation according to the job's configuration
-func (job *Job) Run() error {
+func (job *Job) Run() (err error) {
+	if len(job.sourceJobs) > 0 {
+		return job.runSources()
+	}
+
 	logger.Info.Printf("Starting job with throttle at %.2f%%", job.cfg.ThrottlePercentage)
+	if job.cfg.MaxRowsPerSecond > 0 {
+		logger.Info.Printf("Reading at most %v rows per second", job.cfg.MaxRowsPerSecond)
+	}
+	if job.cfg.MaxBytesPerSecond > 0 {
+		logger.Info.Printf("Reading at most %v bytes per second", job.cfg.MaxBytesPerSecond)
+	}
 	logger.Info.Printf("Changes are synced in chunks of %v", job.cfg.UpdateChunkSize)
 	logger.Info.Printf("Deletions are synced in chunks of %v", job.cfg.DeleteChunkSize)
+	if job.cfg.Parallelism > 1 {
+		logger.Info.Printf("Syncing up to %v tables in parallel", job.cfg.Parallelism)
+	}
+	if job.fanOut() {
+		logger.Info.Printf("Syncing to %v targets", len(job.targets))
+	}
+	job.logTableSettings()
 	job.start = time.Now()
 
+	if !job.schedule.windows.allow(job.start) {
+		logger.Info.Printf("Outside of scheduled job windows, skipping run")
+		return nil
+	}
+	err = job.pauseForBlackouts("")
+	if err != nil {
+		return err
+	}
+
+	// Targets that failed in the previous run are retried
+	for _, target := range job.targets {
+		target.failed = nil
+	}
+
 	logger.Info.Printf("Connecting")
-	err := job.connect()
+	err = job.connect()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		job.close(err)
+	}()
+
+	err = job.eachTarget(func(target *Job) error {
+		err := target.setupStateTable()
+		if err != nil {
+			return fmt.Errorf("failed to setup state table: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
+	if job.cfg.ConsistentSnapshot {
+		err = job.exportSnapshot()
+		if err != nil {
+			return fmt.Errorf("failed to export source snapshot: %w", err)
+		}
+		logger.Info.Printf("Reading from consistent snapshot %s", job.snapshotID)
+	}
+
+	// Tables re-created by validation are part of the atomic transaction
+	if job.cfg.AtomicApply {
+		err = job.beginAtomicApply()
+		if err != nil {
+			return err
+		}
+		defer job.endAtomicApply()
+	}
+
 	logger.Info.Printf("Validating tables")
-	err = job.validateTables()
+	err = job.eachTarget((*Job).validateTables)
 	if err != nil {
 		return err
 	}
@@ -73,6 +190,21 @@ func (job *Job) Run() error {
 		return err
 	}
 
+	if job.cfg.ConsistentSnapshot {
+		err = job.eachTarget((*Job).setConsistentState)
+		if err != nil {
+			return err
+		}
+	}
+
+	if job.cfg.AtomicApply {
+		logger.Info.Printf("Committing all changes")
+		err = job.atomicTx.Commit(job.ctx)
+		if err != nil {
+			return fmt.Errorf("failed to commit changes: %w", err)
+		}
+	}
+
 	logger.Info.Printf("Done")
 	logger.Info.Printf("%v row(s) updated in %v", job.updatedRows, time.Since(job.start))
 	return nil
@@ -84,13 +216,118 @@ func (job *Job) connect() error {
 	if err != nil {
 		return err
 	}
-	job.target, err = pgx.Connect(job.ctx, job.cfg.TargetConnection)
+	if job.fanOut() {
+		err = job.connectTargets()
+		if err != nil {
+			job.source.Close(job.ctx)
+			return err
+		}
+		return nil
+	}
+	if isSQLiteConnection(job.cfg.TargetConnection) || isExportConnection(job.cfg.TargetConnection) {
+		job.sink, err = job.openSink()
+		if err != nil {
+			job.source.Close(job.ctx)
+			return err
+		}
+		return nil
+	}
+	job.targetConn, err = pgx.Connect(job.ctx, job.cfg.TargetConnection)
 	if err != nil {
+		job.source.Close(job.ctx)
 		return err
 	}
+	job.target = job.targetConn
 	return nil
 }
 
+// connectSource opens a new source connection for the job,
+// reading from the consistent snapshot if there is one.
+func (job *Job) connectSource() error {
+	source, err := pgx.Connect(job.ctx, job.cfg.SourceConnection)
+	if err != nil {
+		return err
+	}
+	job.source = source
+	if job.snapshotID != "" {
+		err = job.importSnapshot()
+		if err != nil {
+			source.Close(job.ctx)
+			return err
+		}
+	}
+	return nil
+}
+
+// exportSnapshot starts a repeatable read transaction on the source connection,
+// and exports its snapshot for use by worker connections.
+// The transaction is kept open until the source connection is closed.
+func (job *Job) exportSnapshot() error {
+	_, err := job.source.Exec(job.ctx, "begin isolation level repeatable read read only")
+	if err != nil {
+		return err
+	}
+
+	row := job.source.QueryRow(job.ctx, "select pg_export_snapshot()")
+	err = row.Scan(&job.snapshotID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// importSnapshot starts a repeatable read transaction on the source connection,
+// reading from the snapshot exported by the job.
+func (job *Job) importSnapshot() error {
+	_, err := job.source.Exec(job.ctx, "begin isolation level repeatable read read only")
+	if err != nil {
+		return err
+	}
+
+	_, err = job.source.Exec(job.ctx, fmt.Sprintf("set transaction snapshot '%s'", job.snapshotID))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// beginAtomicApply starts a target transaction, which all following
+// target operations run in, until ended by endAtomicApply.
+func (job *Job) beginAtomicApply() error {
+	tx, err := job.targetConn.Begin(job.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin target transaction: %w", err)
+	}
+	job.atomicTx = tx
+	job.target = tx
+	return nil
+}
+
+// endAtomicApply rolls back any uncommitted changes, and returns
+// to running target operations directly on the connection.
+func (job *Job) endAtomicApply() {
+	if job.atomicTx != nil {
+		job.atomicTx.Rollback(job.ctx)
+		job.atomicTx = nil
+	}
+	job.target = job.targetConn
+}
+
+// close closes the job connections. "runErr" is the error that ended the run,
+// or nil if it succeeded.
+func (job *Job) close(runErr error) {
+	job.source.Close(job.ctx)
+	if job.fanOut() {
+		job.closeTargets()
+		return
+	}
+	if job.sink != nil {
+		job.sink.close(job.ctx, runErr)
+		return
+	}
+	job.targetConn.Close(job.ctx)
+}
+
 var errSchemaMismatch = errors.New("schema mismatch")
 
 func (job *Job) validateTable(table string) error {
@@ -117,35 +354,86 @@ func (job *Job) validateTable(table string) error {
 		}
 	}
 
-	schema, err := extractTableSchema(job.ctx, job.source, table)
+	columnTypes, columnOrder, err := extractColumnTypes(job.ctx, job.source, table)
+	if err != nil {
+		return fmt.Errorf("failed to get column types: %w", err)
+	}
+	selectedColumns, err := job.selectColumns(table, columnOrder)
 	if err != nil {
 		return err
 	}
+	job.columns[table] = selectedColumns
+	if selectedColumns != nil {
+		selectedTypes := make(map[string]columnType)
+		for _, column := range selectedColumns {
+			selectedTypes[column] = columnTypes[column]
+		}
+		columnTypes = selectedTypes
+	}
+	job.columnTypes[table] = columnTypes
+
+	if _, found := columnTypes[job.cfg.SourceColumn]; found && job.fanIn() {
+		return fmt.Errorf("table %q already has a column named %q, set another 'sourceColumn'", table, job.cfg.SourceColumn)
+	}
 
-	targetExists, err := objectExists(job.ctx, job.target, table)
+	schema, err := extractTableSchema(job.ctx, job.source, table, selectedColumns)
+	if err != nil {
+		return err
+	}
+	job.schemas[table] = schema
+	schema = job.targetSchema(schema)
+	// Shadow copies get new indices from the source, leave the old table as is
+	keepTargetIndices := false
+
+	targetTable := job.cfg.targetTable(table)
+	if targetTable != table {
+		schema = renameTableSchema(schema, targetTable)
+	}
+
+	sink := job.targetSink()
+	definition := tableDefinition{
+		schema:      schema,
+		columns:     columnOrder,
+		columnTypes: columnTypes,
+	}
+	if selectedColumns != nil {
+		definition.columns = selectedColumns
+	}
+
+	targetExists, err := sink.tableExists(job.ctx, targetTable)
 	if err != nil {
 		return err
 	}
 	if targetExists {
-		targetSchema, err := extractTableSchema(job.ctx, job.target, table)
+		targetSchema, err := sink.tableSchema(job.ctx, targetTable)
 		if err != nil {
 			return err
 		}
 		if targetSchema != schema {
 			logger.Debug.Printf("Schemas differ:\nsource: %s\ntarget: %s", schema, targetSchema)
-			if job.cfg.ResyncOnSchemaChange {
+			if job.cfg.ResyncOnSchemaChange && job.cfg.ShadowCopy {
+				logger.Info.Printf("Schema for table %q has changed, marking for re-sync", table)
+				job.forceSync[table] = true
+				keepTargetIndices = true
+			} else if job.cfg.ResyncOnSchemaChange {
 				logger.Info.Printf("Schema for table %q has changed, re-creating and marking for re-sync", table)
 				job.forceSync[table] = true
-				err = recreateTable(job.ctx, job.target, table, schema)
+				err = sink.recreateTable(job.ctx, targetTable, definition)
 				if err != nil {
 					return err
 				}
+				if job.fanIn() {
+					err = job.resetTargetTableStates(table)
+					if err != nil {
+						return err
+					}
+				}
 			} else {
 				return errSchemaMismatch
 			}
 		}
 	} else {
-		err = createTable(job.ctx, job.target, table, schema)
+		err = sink.createTable(job.ctx, targetTable, definition)
 
 		if err != nil {
 			return fmt.Errorf("failed to create target table: %w", err)
@@ -156,15 +444,63 @@ func (job *Job) validateTable(table string) error {
 	if err != nil {
 		return err
 	}
+	for _, index := range indices {
+		if index.primary && len(selectIndices([]tableIndex{index}, columnTypes)) == 0 {
+			return fmt.Errorf("primary key columns of table %q cannot be excluded", table)
+		}
+	}
+	indices = selectIndices(indices, columnTypes)
 
-	err = applyIndices(job.ctx, job.target, table, indices)
-	if err != nil {
-		return fmt.Errorf("failed to create indices: %w", err)
+	identity := chooseIdentityIndex(indices)
+	if identity != nil {
+		if !identity.primary {
+			logger.Info.Printf("Table %q has no primary key, using unique index %q as identity", table, identity.indexName)
+			identity.identity = true
+		}
+		job.primaryKeys[table] = identity.columns
+	} else if job.cfg.tableSettings(table).FullCopyWithoutKey {
+		logger.Info.Printf("Table %q has no primary key or usable unique index, will be synced using full copies", table)
 	}
 
-	for _, index := range indices {
-		if index.primary {
-			job.primaryKeys[table] = index.columns
+	job.indices[table] = indices
+
+	if job.sink != nil && job.cfg.SyncDeletes {
+		for _, key := range job.primaryKeys[table] {
+			if !sqliteOrderedKeyTypes[columnTypes[key].oid] {
+				return fmt.Errorf(
+					"key column %q of table %q has type %q, which SQLite and file export targets cannot scan for deletions",
+					key, table, columnTypes[key].name,
+				)
+			}
+		}
+	}
+
+	if !keepTargetIndices {
+		err = sink.createIndices(job.ctx, targetTable, job.targetIndices(indices))
+		if err != nil {
+			return fmt.Errorf("failed to create indices: %w", err)
+		}
+	}
+
+	for column, transform := range job.cfg.tableSettings(table).Transforms {
+		colType, found := columnTypes[column]
+		if !found {
+			return fmt.Errorf("unknown column %q in 'transforms' for table %q", column, table)
+		}
+		for _, key := range job.primaryKeys[table] {
+			if key == column {
+				return fmt.Errorf("key column %q of table %q cannot be transformed", column, table)
+			}
+		}
+		err = transform.validateColumnType(colType)
+		if err != nil {
+			return fmt.Errorf("invalid transform for column %q of table %q: %w", column, table, err)
+		}
+	}
+
+	for _, column := range job.cfg.tableSettings(table).VerifyExcludeColumns {
+		if _, found := columnTypes[column]; !found {
+			return fmt.Errorf("unknown column %q in 'verifyExcludeColumns' for table %q", column, table)
 		}
 	}
 
@@ -173,6 +509,70 @@ func (job *Job) validateTable(table string) error {
 	return nil
 }
 
+// selectColumns returns the table columns to sync according to the table's
+// "columns" or "excludeColumns" settings, in table order. Returns nil if all columns are synced.
+func (job *Job) selectColumns(table string, columns []string) ([]string, error) {
+	settings := job.cfg.tableSettings(table)
+	if len(settings.Columns) == 0 && len(settings.ExcludeColumns) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]bool)
+	for _, column := range columns {
+		known[column] = true
+	}
+	listed := make(map[string]bool)
+	for _, column := range append(append([]string{}, settings.Columns...), settings.ExcludeColumns...) {
+		if !known[column] {
+			return nil, fmt.Errorf("unknown column %q in column selection for table %q", column, table)
+		}
+		listed[column] = true
+	}
+
+	included := len(settings.Columns) > 0
+	var selected []string
+	for _, column := range columns {
+		if listed[column] == included {
+			selected = append(selected, column)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no columns selected for table %q", table)
+	}
+	return selected, nil
+}
+
+// selectIndices returns the indices that only use the given columns
+func selectIndices(indices []tableIndex, columnTypes map[string]columnType) []tableIndex {
+	var selected []tableIndex
+	for _, index := range indices {
+		usable := true
+		for _, column := range index.columns {
+			if _, found := columnTypes[column]; !found {
+				usable = false
+				break
+			}
+		}
+		if usable {
+			selected = append(selected, index)
+		}
+	}
+	return selected
+}
+
+// selectList returns the select list of the synced columns of a table
+func (job *Job) selectList(table string) string {
+	columns := job.columns[table]
+	if columns == nil {
+		return "*"
+	}
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = pgx.Identifier{column}.Sanitize()
+	}
+	return strings.Join(quoted, ", ")
+}
+
 func (job *Job) validateTables() error {
 
 	for _, table := range job.cfg.SourceTables {
@@ -198,6 +598,15 @@ func (job *Job) validateTables() error {
 			if job.cfg.ResyncOnSchemaChange {
 				logger.Info.Printf("Where clause for table %q has changed, marking for re-sync", table)
 				job.forceSync[table] = true
+				if state.copyInProgress() {
+					state.copyKey = nil
+					state.copyStartXmin = 0
+					state.copyCheckedXid = 0
+					err = job.setTableState(table, state)
+					if err != nil {
+						return fmt.Errorf("failed to update table state: %w", err)
+					}
+				}
 			} else {
 				return fmt.Errorf("filtered table %q where clause has changed, and 'resyncOnSchemaChange' is not set", table)
 			}
@@ -211,82 +620,329 @@ func (job *Job) validateTables() error {
 	return nil
 }
 
+// chooseIdentityIndex returns the index identifying table rows, which is the primary key if
+// there is one. Otherwise, the identity candidate with the fewest columns is used.
+func chooseIdentityIndex(indices []tableIndex) *tableIndex {
+	var identity *tableIndex
+	for i, index := range indices {
+		if index.primary {
+			return &indices[i]
+		}
+		if index.identityCandidate && (identity == nil || len(index.columns) < len(identity.columns)) {
+			identity = &indices[i]
+		}
+	}
+	return identity
+}
+
 func (job *Job) getPrimaryKeys(table string) ([]string, error) {
 	primaryKeys := job.primaryKeys[table]
 	if len(primaryKeys) < 1 {
-		return primaryKeys, fmt.Errorf("table %v does not have a primary key", table)
+		return primaryKeys, fmt.Errorf("table %v does not have a primary key or usable unique index", table)
 	}
-	sort.StringSlice(primaryKeys).Sort()
-	return primaryKeys, nil
+	// The keys share their backing array with the identity index columns, which keep the index order
+	sorted := append([]string(nil), primaryKeys...)
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// getPrimaryKeyTypes returns the source column types of the given primary keys
+func (job *Job) getPrimaryKeyTypes(table string, primaryKeys []string) ([]columnType, error) {
+	columnTypes := job.columnTypes[table]
+	keyTypes := make([]columnType, len(primaryKeys))
+	for i, key := range primaryKeys {
+		keyType, found := columnTypes[key]
+		if !found {
+			return nil, fmt.Errorf("unknown type of key column %q in table %q", key, table)
+		}
+		keyTypes[i] = keyType
+	}
+	return keyTypes, nil
+}
+
+// syncTask is a single table to be synced by a worker
+type syncTask struct {
+	table    string
+	where    string
+	filtered bool
+	uses     []string
+}
+
+type syncResult struct {
+	table string
+	err   error
 }
 
 func (job *Job) updateTables() error {
+	job.throttleBudget = newThrottleBudget(job.cfg.ThrottlePercentage, job.cfg.MaxRowsPerSecond, job.cfg.MaxBytesPerSecond)
 
+	var tasks []syncTask
 	for _, table := range job.cfg.SourceTables {
-		err := job.updateTable(table, "")
-		if err != nil {
-			return err
+		if !job.tableScheduled(table, job.start) {
+			logger.Info.Printf("Table %s is not scheduled for syncing yet", table)
+			continue
 		}
+		tasks = append(tasks, syncTask{table: table})
 	}
 
-	for table, filter := range job.cfg.FilteredSourceTables {
-		err := job.updateTable(table, filter.Where)
-		if err != nil {
-			return err
+	var filteredTables []string
+	for table := range job.cfg.FilteredSourceTables {
+		filteredTables = append(filteredTables, table)
+	}
+	sort.Strings(filteredTables)
+	for _, table := range filteredTables {
+		if !job.tableScheduled(table, job.start) {
+			logger.Info.Printf("Table %s is not scheduled for syncing yet", table)
+			continue
+		}
+		filter := job.cfg.FilteredSourceTables[table]
+		tasks = append(tasks, syncTask{
+			table:    table,
+			where:    filter.Where,
+			filtered: true,
+			uses:     filter.Uses,
+		})
+	}
+
+	ctx, cancel := context.WithCancel(job.ctx)
+	defer cancel()
+
+	stopAdaptiveThrottle, err := job.startAdaptiveThrottle(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start adaptive throttle: %w", err)
+	}
+	defer stopAdaptiveThrottle()
+
+	workers, err := job.startWorkers(ctx, int(job.cfg.Parallelism))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The first worker shares connections with the job
+		for _, worker := range workers[1:] {
+			worker.close(nil)
+		}
+	}()
+
+	err = job.runTasks(workers, tasks, cancel)
+	for _, worker := range workers {
+		job.updatedRows += worker.updatedRows
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		job.lastSynced[task.table] = job.start
+	}
+	return nil
+}
+
+// startWorkers creates "parallelism" workers, each being a copy of the job
+// with its own source and target connections, except for the first one
+// which shares connections with the job.
+func (job *Job) startWorkers(ctx context.Context, parallelism int) ([]*Job, error) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	var workers []*Job
+	for i := 0; i < parallelism; i++ {
+		worker := *job
+		worker.ctx = ctx
+		worker.updatedRows = 0
+		if i > 0 {
+			err := worker.connect()
+			if err == nil && job.snapshotID != "" {
+				err = worker.importSnapshot()
+				if err != nil {
+					worker.close(nil)
+				}
+			}
+			if err != nil {
+				for _, started := range workers[1:] {
+					started.close(nil)
+				}
+				return nil, fmt.Errorf("failed to connect worker: %w", err)
+			}
 		}
-		err = job.setTableWhereState(table, filter.Where)
+		workers = append(workers, &worker)
+	}
+	return workers, nil
+}
+
+// runTasks runs sync tasks on the workers, starting tasks as soon
+// as the tables they use are synced. Used tables without tasks are
+// not waited for. Stops at the first error.
+func (job *Job) runTasks(workers []*Job, tasks []syncTask, cancel func()) error {
+	taskQueue := make(chan syncTask)
+	results := make(chan syncResult)
+
+	for _, worker := range workers {
+		go func(worker *Job) {
+			for task := range taskQueue {
+				results <- syncResult{task.table, worker.syncTable(task)}
+			}
+		}(worker)
+	}
+
+	done := make(map[string]bool)
+	scheduled := make(map[string]bool)
+	for _, task := range tasks {
+		scheduled[task.table] = true
+	}
+	isReady := func(task syncTask) bool {
+		for _, used := range task.uses {
+			if scheduled[used] && !done[used] {
+				return false
+			}
+		}
+		return true
+	}
+
+	var firstError error
+	running := 0
+	pending := tasks
+
+	for {
+		for firstError == nil && running < len(workers) {
+			readyIndex := -1
+			for i, task := range pending {
+				if isReady(task) {
+					readyIndex = i
+					break
+				}
+			}
+			if readyIndex < 0 {
+				break
+			}
+			taskQueue <- pending[readyIndex]
+			pending = append(pending[:readyIndex], pending[readyIndex+1:]...)
+			running++
+		}
+
+		if running == 0 {
+			break
+		}
+
+		result := <-results
+		running--
+		done[result.table] = true
+		if result.err != nil && firstError == nil {
+			firstError = result.err
+			cancel()
+		}
+	}
+	close(taskQueue)
+
+	if firstError == nil && len(pending) > 0 {
+		return fmt.Errorf("could not resolve table dependencies for %q", pending[0].table)
+	}
+	return firstError
+}
+
+func (job *Job) syncTable(task syncTask) error {
+	tableJob := job.forTable(task.table)
+	err := tableJob.updateTable(task.table, task.where)
+	job.updatedRows += tableJob.updatedRows
+	if err != nil {
+		return err
+	}
+	if task.filtered {
+		err = job.eachTarget(func(target *Job) error {
+			return target.setTableWhereState(task.table, task.where)
+		})
 		if err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
+// forTable returns a copy of the job using the table's settings overrides
+func (job *Job) forTable(table string) *Job {
+	tableJob := *job
+	tableJob.cfg = job.cfg.forTable(table)
+	tableJob.updatedRows = 0
+	return &tableJob
+}
+
+// logTableSettings logs the effective settings of tables with overrides
+func (job *Job) logTableSettings() {
+	tables := job.cfg.allTables()
+	sort.Strings(tables)
+	for _, table := range tables {
+		if job.cfg.tableSettings(table).TableOverrides == (TableOverrides{}) {
+			continue
+		}
+		tableCfg := job.cfg.forTable(table)
+		logger.Info.Printf(
+			"Table %s: update chunk %v, delete chunks %v - %v, copy chunk %v, throttle %.2f%%, "+
+				"updates %v, deletes %v, full copy threshold %v, apply strategy %s",
+			table, tableCfg.UpdateChunkSize, tableCfg.DeleteChunkSize, tableCfg.MinDeleteChunkSize,
+			tableCfg.CopyChunkSize, tableCfg.ThrottlePercentage,
+			tableCfg.SyncUpdates, tableCfg.SyncDeletes, tableCfg.FullCopyThreshold, tableCfg.ApplyStrategy,
+		)
+	}
+}
+
 func (job *Job) updateTable(table string, where string) error {
+	if len(job.primaryKeys[table]) == 0 && job.cfg.tableSettings(table).FullCopyWithoutKey {
+		return job.eachTarget(func(target *Job) error {
+			return target.copyKeylessTable(table, where)
+		})
+	}
+
 	primaryKeys, err := job.getPrimaryKeys(table)
 	if err != nil {
 		return err
 	}
 
-	var updateRange updateRange
+	now := time.Now()
+	// Targets that were fully copied have no deletions to sync
+	copied := make(map[string]bool)
 
-	if job.cfg.SyncUpdates {
-		logger.Info.Printf("Fetching update range for table %s", table)
-		updateRange, err = job.getUpdateRange(table, where)
+	if job.cfg.SyncUpdates && !job.updatesAllowed(table, now) {
+		logger.Info.Printf("Outside of update windows, skipping updates for table %s", table)
+	} else if job.cfg.SyncUpdates {
+		copied, err = job.syncUpdates(table, primaryKeys, where)
 		if err != nil {
-			return fmt.Errorf("failed to get update range: %w", err)
+			return err
 		}
+	}
 
-		if updateRange.fullTable {
-			logger.Info.Printf("Performing full table sync for stale / empty table")
-			err = job.copyFullTable(table, where)
-			if err != nil {
-				return err
+	if job.cfg.SyncDeletes && !job.deletesAllowed(table, now) {
+		logger.Info.Printf("Outside of delete windows, skipping deletions for table %s", table)
+	} else if job.cfg.SyncDeletes {
+		err = job.eachTargetConcurrently(func(target *Job) error {
+			if copied[target.targetName] {
+				return nil
 			}
-			err = job.setTableXminState(table, updateRange.endXmin)
+			logger.Info.Printf("Syncing deletions for table %s", table)
+			err := target.syncDeletedRows(table, where)
 			if err != nil {
-				return err
+				return fmt.Errorf("failed to sync deletions for table %s: %w", table, err)
 			}
 			return nil
-		}
-
-		if !updateRange.empty() {
-			logger.Info.Printf("Updating table %s", table)
-			err = job.updateTableRange(table, primaryKeys, updateRange, where)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	if job.cfg.SyncDeletes {
-		logger.Info.Printf("Syncing deletions for table %s", table)
-		err = job.syncDeletedRows(table, where)
+		})
 		if err != nil {
-			return fmt.Errorf("failed to sync deletions for table %s: %w", table, err)
+			return err
 		}
 	}
 
 	return nil
 }
+
+// copyKeylessTable syncs tables without row identity by copying the full table
+func (job *Job) copyKeylessTable(table string, where string) error {
+	if !job.cfg.SyncUpdates && !job.cfg.SyncDeletes {
+		return nil
+	}
+	if !job.updatesAllowed(table, time.Now()) {
+		logger.Info.Printf("Outside of update windows, skipping table %s without key", table)
+		return nil
+	}
+
+	logger.Info.Printf("Performing full table sync for table %s without key", table)
+	return job.copyFullTable(table, nil, where)
+}
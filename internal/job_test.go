@@ -0,0 +1,149 @@
+package sslr
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetPrimaryKeyTypes(t *testing.T) {
+	job := &Job{
+		columnTypes: map[string]map[string]columnType{
+			"public.items": {
+				"id":   {name: "integer"},
+				"kind": {name: "text"},
+			},
+		},
+	}
+
+	keyTypes, err := job.getPrimaryKeyTypes("public.items", []string{"kind", "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyTypes) != 2 || keyTypes[0].name != "text" || keyTypes[1].name != "integer" {
+		t.Errorf("key types = %v, expected text, integer", keyTypes)
+	}
+
+	_, err = job.getPrimaryKeyTypes("public.items", []string{"id", "missing"})
+	if err == nil {
+		t.Error("expected error for unknown key column")
+	}
+}
+
+func TestGetPrimaryKeysKeepsIndexOrder(t *testing.T) {
+	identity := tableIndex{indexName: "items_kind_id", unique: true, columns: []string{"kind", "id"}}
+	job := &Job{
+		primaryKeys: map[string][]string{"public.items": identity.columns},
+		indices:     map[string][]tableIndex{"public.items": {identity}},
+	}
+
+	keys, err := job.getPrimaryKeys("public.items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "id" || keys[1] != "kind" {
+		t.Errorf("keys = %v, expected sorted keys", keys)
+	}
+	columns := job.indices["public.items"][0].columns
+	if columns[0] != "kind" || columns[1] != "id" {
+		t.Errorf("index columns = %v, expected the original index order", columns)
+	}
+}
+
+// runTestJob runs a job with the given config, filling in the test database connections
+func runTestJob(t *testing.T, settings map[string]interface{}) {
+	t.Helper()
+	url := os.Getenv("SSLR_TEST_DATABASE")
+	settings["source"] = url
+	settings["target"] = url
+
+	dir, err := ioutil.TempDir("", "sslr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := json.Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(configFile, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := NewJob(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = job.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAtomicApplyRun(t *testing.T) {
+	conn := testConnection(t)
+	ctx := context.Background()
+
+	cleanup := `--sql
+	drop schema if exists atomic_apply_target cascade;
+	drop table if exists public.atomic_apply_items, public.atomic_apply_state;
+	`
+	_, err := conn.Exec(ctx, cleanup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Exec(context.Background(), cleanup)
+	})
+	_, err = conn.Exec(ctx, `--sql
+	create schema atomic_apply_target;
+	create table public.atomic_apply_items (id int primary key, name text);
+	create index atomic_apply_items_name on public.atomic_apply_items (name);
+	insert into public.atomic_apply_items select i, 'item ' || i from generate_series(1, 10) i;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := map[string]interface{}{
+		"tables":        []string{"public.atomic_apply_items"},
+		"schemaMapping": map[string]string{"public": "atomic_apply_target"},
+		"stateTable":    "atomic_apply_state",
+		"atomicApply":   true,
+	}
+	runTestJob(t, settings)
+
+	_, err = conn.Exec(ctx, `--sql
+	insert into public.atomic_apply_items values (11, 'item 11');
+	delete from public.atomic_apply_items where id = 1;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestJob(t, settings)
+
+	var rows, indices int
+	err = conn.QueryRow(ctx, "select count(*) from atomic_apply_target.atomic_apply_items where id between 2 and 11").Scan(&rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 10 {
+		t.Errorf("target has %d of 10 synced rows", rows)
+	}
+	err = conn.QueryRow(ctx, "select count(*) from pg_indexes where schemaname = 'atomic_apply_target'").Scan(&indices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indices != 2 {
+		t.Errorf("target has %d of 2 indices", indices)
+	}
+}
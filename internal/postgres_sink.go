@@ -0,0 +1,219 @@
+package sslr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// postgresSink writes to a Postgres target connection or transaction
+type postgresSink struct {
+	conn       dbConn
+	stateTable string
+	// Set when "conn" is a transaction, where indices cannot be created concurrently
+	inTransaction bool
+}
+
+func (s postgresSink) setupState(ctx context.Context) error {
+	q := fmt.Sprintf(`--sql
+	create table if not exists %s (
+		table_name varchar(512) primary key,
+		last_seen_xmin bigint,
+		where_clause varchar,
+		checked_xid bigint,
+		copy_key varchar[],
+		copy_start_xmin bigint,
+		copy_checked_xid bigint
+	)
+	;`, s.stateTable)
+
+	_, err := s.conn.Exec(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf(`--sql
+	alter table %s
+		add column if not exists checked_xid bigint,
+		add column if not exists copy_key varchar[],
+		add column if not exists copy_start_xmin bigint,
+		add column if not exists copy_checked_xid bigint
+	;`, s.stateTable)
+
+	_, err = s.conn.Exec(ctx, q)
+	return err
+}
+
+func (s postgresSink) loadState(ctx context.Context, key string) (tableState, error) {
+	var state tableState
+
+	q := fmt.Sprintf(`--sql
+	select
+		coalesce(last_seen_xmin, 0), coalesce(checked_xid, 0), coalesce(where_clause, ''),
+		copy_key, coalesce(copy_start_xmin, 0), coalesce(copy_checked_xid, 0)
+	from %s
+	where table_name = $1
+	;`, s.stateTable)
+
+	row := s.conn.QueryRow(ctx, q, key)
+	err := row.Scan(
+		&state.lastSeenXmin, &state.checkedXid, &state.whereClause,
+		&state.copyKey, &state.copyStartXmin, &state.copyCheckedXid,
+	)
+	if err == pgx.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to load table state: %w", err)
+	}
+
+	return state, nil
+}
+
+func (s postgresSink) storeState(ctx context.Context, key string, state tableState) error {
+	q := fmt.Sprintf(`--sql
+	insert into %s (
+		table_name, last_seen_xmin, where_clause, checked_xid,
+		copy_key, copy_start_xmin, copy_checked_xid
+	) values($1, $2, $3, $4, $5, $6, $7)
+	on conflict (table_name)
+	do update set
+		last_seen_xmin = $2, where_clause = $3, checked_xid = $4,
+		copy_key = $5, copy_start_xmin = $6, copy_checked_xid = $7
+	;`, s.stateTable)
+
+	_, err := s.conn.Exec(
+		ctx, q, key, state.lastSeenXmin, state.whereClause, state.checkedXid,
+		state.copyKey, state.copyStartXmin, state.copyCheckedXid,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set table state: %w", err)
+	}
+	return nil
+}
+
+func (s postgresSink) tableExists(ctx context.Context, table string) (bool, error) {
+	return objectExists(ctx, s.conn, table)
+}
+
+func (s postgresSink) tableSchema(ctx context.Context, table string) (string, error) {
+	return extractTableSchema(ctx, s.conn, table, nil)
+}
+
+func (s postgresSink) createTable(ctx context.Context, table string, definition tableDefinition) error {
+	return createTable(ctx, s.conn, table, definition.schema)
+}
+
+func (s postgresSink) recreateTable(ctx context.Context, table string, definition tableDefinition) error {
+	return recreateTable(ctx, s.conn, table, definition.schema)
+}
+
+func (s postgresSink) createIndices(ctx context.Context, table string, indices []tableIndex) error {
+	return applyIndices(ctx, s.conn, table, indices, !s.inTransaction)
+}
+
+func (s postgresSink) tableLength(ctx context.Context, table string, where string) (uint64, error) {
+	return getTableLength(ctx, s.conn, table, where)
+}
+
+func (s postgresSink) keyHash(ctx context.Context, table string, primaryKeys []string, hashedColumns []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string) (string, error) {
+	hash, _, _, err := getKeyHash(ctx, s.conn, table, primaryKeys, hashedColumns, startKey, endKey, where)
+	return hash, err
+}
+
+func (s postgresSink) sourceKeyHash(ctx context.Context, source dbConn, throttle *throttledOperation, table string, primaryKeys []string, hashedColumns []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string) (string, error) {
+	hash, rows, bytes, err := getKeyHash(ctx, source, table, primaryKeys, hashedColumns, startKey, endKey, where)
+	throttle.record(rows, bytes)
+	return hash, err
+}
+
+func (s postgresSink) applyChunk(ctx context.Context, table string, primaryKeys []string, keyTypes []columnType, columns []string, rows [][]interface{}, xmins []uint64, strategy string) error {
+	if strategy == applyUpsert {
+		return applyUpserts(ctx, s.conn, table, primaryKeys, columns, rows)
+	}
+	return applyUpdates(ctx, s.conn, table, primaryKeys, keyTypes, columns, rows)
+}
+
+func (s postgresSink) replaceRange(ctx context.Context, table string, primaryKeys []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string, columns []string, rows pgx.CopyFromSource) (int64, error) {
+	tx, err := s.conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	var extraWhereClause string
+	if len(where) > 0 {
+		extraWhereClause = "and " + where
+	}
+
+	whereClause, queryParameters := whereClauseFromKeyRange(primaryKeys, startKey, endKey)
+
+	d := fmt.Sprintf(`--sql
+	delete from
+		%[1]s
+	where
+		%[2]s
+		%[3]s
+	;`, table, whereClause, extraWhereClause)
+
+	_, err = tx.Exec(ctx, d, queryParameters...)
+	if err != nil {
+		return 0, err
+	}
+
+	copied, err := tx.CopyFrom(ctx, strings.Split(table, "."), columns, rows)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+	tx = nil
+	return copied, nil
+}
+
+func (s postgresSink) replaceTable(ctx context.Context, table string, where string, copy func(target rowCopier) error) error {
+	tx, err := s.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if tx != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	var whereClause string
+	if len(where) > 0 {
+		whereClause = "where " + where
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf("delete from %s %s", table, whereClause))
+	if err != nil {
+		return fmt.Errorf("failed to delete old data: %w", err)
+	}
+
+	err = copy(tx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	tx = nil
+	return nil
+}
+
+// close does nothing, since the target connection is owned by the job
+func (s postgresSink) close(ctx context.Context, runErr error) {
+}
@@ -0,0 +1,462 @@
+package sslr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/logger"
+)
+
+// schedule is a parsed ScheduleSettings
+type schedule struct {
+	cron          *cronExpression
+	windows       timeWindows
+	updateWindows timeWindows
+	deleteWindows timeWindows
+	blackouts     timeWindows
+}
+
+func (settings ScheduleSettings) parse() (schedule, error) {
+	var result schedule
+	var err error
+
+	if len(settings.Cron) > 0 {
+		result.cron, err = parseCronExpression(settings.Cron)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.windows, err = parseTimeWindows(settings.Windows)
+	if err != nil {
+		return result, err
+	}
+	result.updateWindows, err = parseTimeWindows(settings.UpdateWindows)
+	if err != nil {
+		return result, err
+	}
+	result.deleteWindows, err = parseTimeWindows(settings.DeleteWindows)
+	if err != nil {
+		return result, err
+	}
+	result.blackouts, err = parseTimeWindows(settings.Blackouts)
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// NextRun returns when to start the next job run in continuous mode.
+// Runs are started at the next cron time when set, and otherwise after
+// "waitBetweenJobs". Runs are postponed until a job window opens.
+func (job *Job) NextRun(now time.Time) time.Time {
+	next := now.Add(job.cfg.WaitBetweenJobs)
+	if job.schedule.cron != nil {
+		next = job.schedule.cron.next(now)
+	}
+	return job.schedule.windows.nextAllowed(next)
+}
+
+// tableScheduled checks if a table with a cron schedule is due for syncing
+func (job *Job) tableScheduled(table string, now time.Time) bool {
+	cron := job.tableSchedules[table].cron
+	if cron == nil {
+		return true
+	}
+	lastSynced, synced := job.lastSynced[table]
+	return !synced || !cron.next(lastSynced).After(now)
+}
+
+// updatesAllowed checks if update windows allow syncing updates to the table
+func (job *Job) updatesAllowed(table string, now time.Time) bool {
+	tableSchedule := job.tableSchedules[table]
+	return job.schedule.updateWindows.allow(now) &&
+		tableSchedule.windows.allow(now) &&
+		tableSchedule.updateWindows.allow(now)
+}
+
+// deletesAllowed checks if delete windows allow syncing deletes to the table
+func (job *Job) deletesAllowed(table string, now time.Time) bool {
+	tableSchedule := job.tableSchedules[table]
+	return job.schedule.deleteWindows.allow(now) &&
+		tableSchedule.windows.allow(now) &&
+		tableSchedule.deleteWindows.allow(now)
+}
+
+// pauseForBlackouts waits until no job or table blackout is active.
+// Called at chunk boundaries, with no source query or target transaction open.
+func (job *Job) pauseForBlackouts(table string) error {
+	blackouts := append(timeWindows{}, job.schedule.blackouts...)
+	blackouts = append(blackouts, job.tableSchedules[table].blackouts...)
+
+	for {
+		now := time.Now()
+		end, active := blackouts.activeUntil(now)
+		if !active {
+			return nil
+		}
+		logger.Info.Printf("Pausing for blackout until %v", end.Format(time.RFC3339))
+		select {
+		case <-time.After(end.Sub(now)):
+		case <-job.ctx.Done():
+			return job.ctx.Err()
+		}
+	}
+}
+
+// timeWindow is either a daily recurring period in local time, like "01:00-05:00",
+// or an absolute period in RFC3339 format, like "2020-10-20T01:00:00Z/2020-10-20T03:00:00Z"
+type timeWindow struct {
+	daily bool
+	// Daily windows, in minutes since midnight.
+	// Windows with end before start pass midnight.
+	startMinute int
+	endMinute   int
+	// Absolute windows
+	from time.Time
+	to   time.Time
+}
+
+func parseTimeWindow(spec string) (timeWindow, error) {
+	var window timeWindow
+
+	if parts := strings.Split(spec, "/"); len(parts) == 2 {
+		var err error
+		window.from, err = time.Parse(time.RFC3339, strings.TrimSpace(parts[0]))
+		if err == nil {
+			window.to, err = time.Parse(time.RFC3339, strings.TrimSpace(parts[1]))
+		}
+		if err != nil {
+			return window, fmt.Errorf("invalid time window %q: %w", spec, err)
+		}
+		if !window.to.After(window.from) {
+			return window, fmt.Errorf("invalid time window %q, end is not after start", spec)
+		}
+		return window, nil
+	}
+
+	parts := strings.Split(spec, "-")
+	if len(parts) != 2 {
+		return window, fmt.Errorf("invalid time window %q, expected \"HH:MM-HH:MM\" or \"<RFC3339>/<RFC3339>\"", spec)
+	}
+	var err error
+	window.daily = true
+	window.startMinute, err = parseTimeOfDay(parts[0])
+	if err == nil {
+		window.endMinute, err = parseTimeOfDay(parts[1])
+	}
+	if err != nil {
+		return window, fmt.Errorf("invalid time window %q: %w", spec, err)
+	}
+	if window.startMinute == window.endMinute {
+		return window, fmt.Errorf("invalid time window %q, empty period", spec)
+	}
+	return window, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into minutes since midnight
+func parseTimeOfDay(spec string) (int, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(spec))
+	if err != nil {
+		return 0, err
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	if !w.daily {
+		return !t.Before(w.from) && t.Before(w.to)
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if w.startMinute < w.endMinute {
+		return minute >= w.startMinute && minute < w.endMinute
+	}
+	return minute >= w.startMinute || minute < w.endMinute
+}
+
+// nextStart returns the next start of the window at or after t,
+// or the zero time if the window will not start again
+func (w timeWindow) nextStart(t time.Time) time.Time {
+	if !w.daily {
+		if t.After(w.from) {
+			return time.Time{}
+		}
+		return w.from
+	}
+	return nextTimeOfDay(t, w.startMinute)
+}
+
+// endAfter returns the end of the window containing t
+func (w timeWindow) endAfter(t time.Time) time.Time {
+	if !w.daily {
+		return w.to
+	}
+	return nextTimeOfDay(t, w.endMinute)
+}
+
+// nextTimeOfDay returns the first time at or after t at the given minute of day.
+// A minute of day skipped by a daylight saving time change is replaced by
+// the end of the gap.
+func nextTimeOfDay(t time.Time, minuteOfDay int) time.Time {
+	year, month, day := t.Date()
+	next := timeOfDay(year, month, day, minuteOfDay, t.Location())
+	if next.Before(t) {
+		next = timeOfDay(year, month, day+1, minuteOfDay, t.Location())
+	}
+	return next
+}
+
+func timeOfDay(year int, month time.Month, day int, minuteOfDay int, location *time.Location) time.Time {
+	result := time.Date(year, month, day, minuteOfDay/60, minuteOfDay%60, 0, 0, location)
+	// Times in a gap are normalized to after it, step back to its end
+	for {
+		previous := result.Add(-time.Minute)
+		if previous.Day() != result.Day() || previous.Hour()*60+previous.Minute() < minuteOfDay {
+			return result
+		}
+		result = previous
+	}
+}
+
+type timeWindows []timeWindow
+
+func parseTimeWindows(specs []string) (timeWindows, error) {
+	var windows timeWindows
+	for _, spec := range specs {
+		window, err := parseTimeWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// allow returns true if t is inside any of the windows, or if there are no windows
+func (ws timeWindows) allow(t time.Time) bool {
+	if len(ws) == 0 {
+		return true
+	}
+	for _, w := range ws {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextAllowed returns the first time at or after t allowed by the windows.
+// Returns t if no window will open again.
+func (ws timeWindows) nextAllowed(t time.Time) time.Time {
+	if ws.allow(t) {
+		return t
+	}
+	var next time.Time
+	for _, w := range ws {
+		start := w.nextStart(t)
+		if !start.IsZero() && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+	if next.IsZero() {
+		return t
+	}
+	return next
+}
+
+// activeUntil returns the end of the active windows at t,
+// following overlapping and adjacent windows.
+func (ws timeWindows) activeUntil(t time.Time) (time.Time, bool) {
+	end := t
+	active := false
+	// Bounded, since daily windows can cover the whole day
+	for i, extended := 0, true; extended && i <= 2*len(ws); i++ {
+		extended = false
+		for _, w := range ws {
+			if w.contains(end) {
+				end = w.endAfter(end)
+				active = true
+				extended = true
+			}
+		}
+	}
+	return end, active
+}
+
+// cronExpression is a parsed standard five field cron expression:
+// minute, hour, day of month, month and day of week
+type cronExpression struct {
+	minutes     uint64
+	hours       uint64
+	daysOfMonth uint64
+	months      uint64
+	daysOfWeek  uint64
+	// Unrestricted day fields, for standard cron day matching
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+var cronShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCronExpression(spec string) (*cronExpression, error) {
+	expanded := strings.TrimSpace(spec)
+	if shorthand, found := cronShorthands[expanded]; found {
+		expanded = shorthand
+	}
+
+	fields := strings.Fields(expanded)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q, expected five fields", spec)
+	}
+
+	var cron cronExpression
+	var err error
+	fieldSpecs := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&cron.minutes, 0, 59},
+		{&cron.hours, 0, 23},
+		{&cron.daysOfMonth, 1, 31},
+		{&cron.months, 1, 12},
+		{&cron.daysOfWeek, 0, 7},
+	}
+	for i, field := range fields {
+		*fieldSpecs[i].bits, err = parseCronField(field, fieldSpecs[i].min, fieldSpecs[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", spec, err)
+		}
+	}
+
+	// Both 0 and 7 are Sunday
+	if cron.daysOfWeek&(1<<7) != 0 {
+		cron.daysOfWeek |= 1
+	}
+	cron.anyDayOfMonth = strings.HasPrefix(fields[2], "*")
+	cron.anyDayOfWeek = strings.HasPrefix(fields[4], "*")
+
+	if cron.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", spec)
+	}
+
+	return &cron, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and
+// steps into a bit set of allowed values
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[slash+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:slash]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			start, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			end = start
+			if len(bounds) == 2 {
+				end, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if step > 1 {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("value out of range in %q", part)
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return bits, nil
+}
+
+func (c *cronExpression) matchesDay(t time.Time) bool {
+	dayOfMonth := c.daysOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := c.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.anyDayOfMonth && c.anyDayOfWeek:
+		return true
+	case c.anyDayOfMonth:
+		return dayOfWeek
+	case c.anyDayOfWeek:
+		return dayOfMonth
+	default:
+		return dayOfMonth || dayOfWeek
+	}
+}
+
+// next returns the first matching time after t, or the zero time
+// if there is none within five years.
+//
+// Matching is done on wall clock times, which are then placed in the location of t.
+// Times skipped by a daylight saving time change are moved forward by the length
+// of the gap, and repeated times match once.
+func (c *cronExpression) next(t time.Time) time.Time {
+	location := t.Location()
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	limit := wall.AddDate(5, 0, 0)
+
+	for {
+		wall = c.nextWallClock(wall, limit)
+		if wall.IsZero() {
+			return time.Time{}
+		}
+		year, month, day := wall.Date()
+		next := time.Date(year, month, day, wall.Hour(), wall.Minute(), 0, 0, location)
+		if next.After(t) {
+			return next
+		}
+	}
+}
+
+// nextWallClock returns the first matching wall clock time after "wall", given in UTC,
+// or the zero time if there is none before "limit"
+func (c *cronExpression) nextWallClock(wall time.Time, limit time.Time) time.Time {
+	next := wall.Add(time.Minute)
+
+	for next.Before(limit) {
+		year, month, day := next.Date()
+		switch {
+		case c.months&(1<<uint(month)) == 0:
+			next = time.Date(year, month+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchesDay(next):
+			next = time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC)
+		case c.hours&(1<<uint(next.Hour())) == 0:
+			next = time.Date(year, month, day, next.Hour()+1, 0, 0, 0, time.UTC)
+		case c.minutes&(1<<uint(next.Minute())) == 0:
+			next = next.Add(time.Minute)
+		default:
+			return next
+		}
+	}
+	return time.Time{}
+}
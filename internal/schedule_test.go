@@ -0,0 +1,352 @@
+package sslr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		expected []int
+	}{
+		{"*", 0, 6, []int{0, 1, 2, 3, 4, 5, 6}},
+		{"5", 0, 59, []int{5}},
+		{"1-3", 0, 59, []int{1, 2, 3}},
+		{"*/15", 0, 59, []int{0, 15, 30, 45}},
+		{"10/20", 0, 59, []int{10, 30, 50}},
+		{"1-10/4", 0, 59, []int{1, 5, 9}},
+		{"1,3,5", 0, 59, []int{1, 3, 5}},
+		{"1-2,20-21/1,40", 0, 59, []int{1, 2, 20, 21, 40}},
+		{"31", 1, 31, []int{31}},
+		{"0,7", 0, 7, []int{0, 7}},
+	}
+
+	for _, test := range tests {
+		bits, err := parseCronField(test.field, test.min, test.max)
+		if err != nil {
+			t.Errorf("parseCronField(%q) failed: %v", test.field, err)
+			continue
+		}
+		var expected uint64
+		for _, value := range test.expected {
+			expected |= 1 << uint(value)
+		}
+		if bits != expected {
+			t.Errorf("parseCronField(%q) = %b, expected %b", test.field, bits, expected)
+		}
+	}
+}
+
+func TestParseCronFieldErrors(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+	}{
+		{"60", 0, 59},
+		{"0", 1, 31},
+		{"5-1", 0, 59},
+		{"*/0", 0, 59},
+		{"*/x", 0, 59},
+		{"a", 0, 59},
+		{"1-b", 0, 59},
+		{"", 0, 59},
+		{"1,,2", 0, 59},
+	}
+
+	for _, test := range tests {
+		_, err := parseCronField(test.field, test.min, test.max)
+		if err == nil {
+			t.Errorf("parseCronField(%q) succeeded, expected error", test.field)
+		}
+	}
+}
+
+func TestParseCronExpressionErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"0 24 * * *",
+		"0 0 0 * *",
+		"0 0 * 13 *",
+		"0 0 * * 8",
+		"0 0 31 2 *",
+		"@often",
+	} {
+		_, err := parseCronExpression(spec)
+		if err == nil {
+			t.Errorf("parseCronExpression(%q) succeeded, expected error", spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(spec string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04", spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		cron     string
+		from     string
+		expected string
+	}{
+		{"* * * * *", "2020-10-20 10:00", "2020-10-20 10:01"},
+		{"*/15 * * * *", "2020-10-20 10:07", "2020-10-20 10:15"},
+		{"*/15 * * * *", "2020-10-20 10:45", "2020-10-20 11:00"},
+		{"0 3 * * *", "2020-10-20 03:00", "2020-10-21 03:00"},
+		{"30 1,13 * * *", "2020-10-20 02:00", "2020-10-20 13:30"},
+		{"0 0 1 * *", "2020-12-15 00:00", "2021-01-01 00:00"},
+		{"0 0 29 2 *", "2021-01-01 00:00", "2024-02-29 00:00"},
+		{"@hourly", "2020-10-20 23:59", "2020-10-21 00:00"},
+		{"@weekly", "2020-10-20 00:00", "2020-10-25 00:00"},
+		// Sunday is both 0 and 7
+		{"0 0 * * 7", "2020-10-20 00:00", "2020-10-25 00:00"},
+		{"0 12 * * 1-5", "2020-10-24 00:00", "2020-10-26 12:00"},
+		// Restricted day of month and day of week match either
+		{"0 0 13 * 5", "2020-10-20 00:00", "2020-10-23 00:00"},
+		{"0 0 13 * 5", "2020-11-07 00:00", "2020-11-13 00:00"},
+		// Restricted day of month only
+		{"0 0 13 * *", "2020-10-20 00:00", "2020-11-13 00:00"},
+	}
+
+	for _, test := range tests {
+		cron, err := parseCronExpression(test.cron)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := cron.next(at(test.from))
+		if !next.Equal(at(test.expected)) {
+			t.Errorf("%q from %s = %v, expected %s", test.cron, test.from, next, test.expected)
+		}
+	}
+}
+
+func stockholm(t *testing.T) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		t.Skip("time zone data not available")
+	}
+	return location
+}
+
+func TestCronNextDST(t *testing.T) {
+	location := stockholm(t)
+	at := func(spec string) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04 MST", spec, location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	// Clocks moved from 02:00 CET to 03:00 CEST on 2021-03-28,
+	// and from 03:00 CEST to 02:00 CET on 2021-10-31
+	tests := []struct {
+		cron     string
+		from     string
+		expected []string
+	}{
+		// Skipped times are moved forward by the gap
+		{"30 2 * * *", "2021-03-27 12:00 CET", []string{
+			"2021-03-28 03:30 CEST", "2021-03-29 02:30 CEST",
+		}},
+		{"0 * * * *", "2021-03-28 00:30 CET", []string{
+			"2021-03-28 01:00 CET", "2021-03-28 03:00 CEST", "2021-03-28 04:00 CEST",
+		}},
+		// Repeated times match once
+		{"30 2 * * *", "2021-10-30 12:00 CEST", []string{
+			"2021-10-31 02:30 CET", "2021-11-01 02:30 CET",
+		}},
+		{"0 3 * * *", "2021-10-30 12:00 CEST", []string{
+			"2021-10-31 03:00 CET", "2021-11-01 03:00 CET",
+		}},
+	}
+
+	for _, test := range tests {
+		cron, err := parseCronExpression(test.cron)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := at(test.from)
+		for _, expected := range test.expected {
+			next = cron.next(next)
+			if !next.Equal(at(expected)) {
+				t.Errorf("%q from %s = %v, expected %s", test.cron, test.from, next, expected)
+				break
+			}
+		}
+	}
+}
+
+func TestParseTimeWindowErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"01:00",
+		"01:00-",
+		"25:00-02:00",
+		"01:00-01:00",
+		"01:00-02:00-03:00",
+		"2020-10-20T03:00:00Z/2020-10-20T01:00:00Z",
+		"2020-10-20T01:00:00Z/tomorrow",
+	} {
+		_, err := parseTimeWindow(spec)
+		if err == nil {
+			t.Errorf("parseTimeWindow(%q) succeeded, expected error", spec)
+		}
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	at := func(spec string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		window   string
+		time     string
+		expected bool
+	}{
+		{"01:00-05:00", "2020-10-20T00:59:00Z", false},
+		{"01:00-05:00", "2020-10-20T01:00:00Z", true},
+		{"01:00-05:00", "2020-10-20T04:59:00Z", true},
+		{"01:00-05:00", "2020-10-20T05:00:00Z", false},
+		// Daily windows crossing midnight
+		{"22:00-02:00", "2020-10-20T21:59:00Z", false},
+		{"22:00-02:00", "2020-10-20T22:00:00Z", true},
+		{"22:00-02:00", "2020-10-20T23:59:00Z", true},
+		{"22:00-02:00", "2020-10-21T00:00:00Z", true},
+		{"22:00-02:00", "2020-10-21T01:59:00Z", true},
+		{"22:00-02:00", "2020-10-21T02:00:00Z", false},
+		{"22:00-02:00", "2020-10-21T12:00:00Z", false},
+		// Absolute windows
+		{"2020-10-20T01:00:00Z/2020-10-21T03:00:00Z", "2020-10-20T00:59:59Z", false},
+		{"2020-10-20T01:00:00Z/2020-10-21T03:00:00Z", "2020-10-20T01:00:00Z", true},
+		{"2020-10-20T01:00:00Z/2020-10-21T03:00:00Z", "2020-10-21T02:59:59Z", true},
+		{"2020-10-20T01:00:00Z/2020-10-21T03:00:00Z", "2020-10-21T03:00:00Z", false},
+		{"2020-10-20T01:00:00+02:00/2020-10-20T03:00:00+02:00", "2020-10-19T23:30:00Z", true},
+	}
+
+	for _, test := range tests {
+		window, err := parseTimeWindow(test.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if window.contains(at(test.time)) != test.expected {
+			t.Errorf("window %q contains %s, expected %v", test.window, test.time, test.expected)
+		}
+	}
+}
+
+func TestTimeWindows(t *testing.T) {
+	at := func(spec string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	parse := func(specs ...string) timeWindows {
+		windows, err := parseTimeWindows(specs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return windows
+	}
+
+	none := parse()
+	if !none.allow(at("2020-10-20T12:00:00Z")) {
+		t.Error("no windows should allow any time")
+	}
+
+	nextAllowedTests := []struct {
+		windows  timeWindows
+		time     string
+		expected string
+	}{
+		{parse("01:00-05:00"), "2020-10-20T03:00:00Z", "2020-10-20T03:00:00Z"},
+		{parse("01:00-05:00"), "2020-10-20T06:00:00Z", "2020-10-21T01:00:00Z"},
+		{parse("01:00-05:00", "12:00-13:00"), "2020-10-20T06:00:00Z", "2020-10-20T12:00:00Z"},
+		{parse("22:00-02:00"), "2020-10-20T12:00:00Z", "2020-10-20T22:00:00Z"},
+		{parse("2020-10-21T01:00:00Z/2020-10-21T03:00:00Z"), "2020-10-20T12:00:00Z", "2020-10-21T01:00:00Z"},
+		// Windows that have passed never open again
+		{parse("2020-10-19T01:00:00Z/2020-10-19T03:00:00Z"), "2020-10-20T12:00:00Z", "2020-10-20T12:00:00Z"},
+	}
+	for _, test := range nextAllowedTests {
+		next := test.windows.nextAllowed(at(test.time))
+		if !next.Equal(at(test.expected)) {
+			t.Errorf("next allowed after %s = %v, expected %s", test.time, next, test.expected)
+		}
+	}
+
+	activeUntilTests := []struct {
+		windows  timeWindows
+		time     string
+		expected string
+		active   bool
+	}{
+		{parse("01:00-05:00"), "2020-10-20T06:00:00Z", "2020-10-20T06:00:00Z", false},
+		{parse("01:00-05:00"), "2020-10-20T03:00:00Z", "2020-10-20T05:00:00Z", true},
+		{parse("22:00-02:00"), "2020-10-20T23:00:00Z", "2020-10-21T02:00:00Z", true},
+		// Overlapping and adjacent windows are followed
+		{parse("01:00-03:00", "02:00-04:00", "04:00-05:00"), "2020-10-20T01:30:00Z", "2020-10-20T05:00:00Z", true},
+		{parse("22:00-02:00", "2020-10-21T01:00:00Z/2020-10-21T06:00:00Z"), "2020-10-20T23:00:00Z", "2020-10-21T06:00:00Z", true},
+	}
+	for _, test := range activeUntilTests {
+		end, active := test.windows.activeUntil(at(test.time))
+		if active != test.active || !end.Equal(at(test.expected)) {
+			t.Errorf("active until at %s = %v, %v, expected %s, %v", test.time, end, active, test.expected, test.active)
+		}
+	}
+
+	// Windows covering the whole day end
+	_, active := parse("00:00-12:00", "12:00-00:00").activeUntil(at("2020-10-20T06:00:00Z"))
+	if !active {
+		t.Error("expected whole day windows to be active")
+	}
+}
+
+func TestTimeWindowsDST(t *testing.T) {
+	location := stockholm(t)
+	at := func(spec string) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04 MST", spec, location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	// The window starts in the skipped hour, and opens at the end of the gap
+	windows, err := parseTimeWindows([]string{"02:30-03:30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := windows.nextAllowed(at("2021-03-28 00:00 CET"))
+	if !next.Equal(at("2021-03-28 03:00 CEST")) || !windows.allow(next) {
+		t.Errorf("next allowed = %v, expected 2021-03-28 03:00 CEST", next)
+	}
+
+	// Daily windows follow local time across the change
+	windows, err = parseTimeWindows([]string{"22:00-02:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	end, active := windows.activeUntil(at("2021-03-27 23:00 CET"))
+	if !active || !end.Equal(at("2021-03-28 02:00 CET")) {
+		t.Errorf("active until = %v, %v, expected 2021-03-28 02:00 CET", end, active)
+	}
+	next = windows.nextAllowed(at("2021-10-31 12:00 CET"))
+	if !next.Equal(at("2021-10-31 22:00 CET")) {
+		t.Errorf("next allowed = %v, expected 2021-10-31 22:00 CET", next)
+	}
+}
@@ -1,15 +1,22 @@
 package sslr
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
 	"database/sql/driver"
+	"errors"
 	"fmt"
+	"reflect"
 	"strings"
+	"time"
+	"unicode/utf8"
 
-	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgtype"
 )
 
-// PrimaryKey wraps integer and string valued keys
+// PrimaryKey wraps key values of any type that can be indexed using btree,
+// as decoded by pgx
 type PrimaryKey struct {
 	value interface{}
 }
@@ -24,7 +31,7 @@ func (pks PrimaryKeySet) Equals(other PrimaryKeySet) bool {
 	}
 
 	for i := range pks {
-		if pks[i] != other[i] {
+		if !pks[i].Equals(other[i]) {
 			return false
 		}
 	}
@@ -32,27 +39,81 @@ func (pks PrimaryKeySet) Equals(other PrimaryKeySet) bool {
 	return true
 }
 
+// Values returns the plain key values, for use as query parameters
+func (pks PrimaryKeySet) Values() []interface{} {
+	values := make([]interface{}, len(pks))
+	for i, key := range pks {
+		values[i] = key.value
+	}
+	return values
+}
+
+// Equals compares two key values
+func (pk PrimaryKey) Equals(other PrimaryKey) bool {
+	switch value := pk.value.(type) {
+	case time.Time:
+		otherValue, ok := other.value.(time.Time)
+		return ok && value.Equal(otherValue)
+	case []byte:
+		otherValue, ok := other.value.([]byte)
+		return ok && bytes.Equal(value, otherValue)
+	default:
+		return reflect.DeepEqual(pk.value, other.value)
+	}
+}
+
 // Scan implements Scanner interface
 func (pk *PrimaryKey) Scan(value interface{}) error {
-	switch value.(type) {
-	case int64, string:
-		pk.value = value
-	default:
-		return fmt.Errorf("Unhandled primary key type: %v", value)
+	if value == nil {
+		return errors.New("Primary key cannot be null")
 	}
+	pk.value = value
 	return nil
 }
 
 // Value implements Valuer interface
 func (pk *PrimaryKey) Value() (driver.Value, error) {
-	switch pk.value.(type) {
-	case int64:
-		return driver.Int32.ConvertValue(pk.value)
+	switch value := pk.value.(type) {
+	case driver.Valuer:
+		return value.Value()
+	case [16]byte:
+		return pgtype.UUID{Bytes: value, Status: pgtype.Present}.Value()
+	default:
+		return driver.DefaultParameterConverter.ConvertValue(pk.value)
+	}
+}
+
+// Text returns the key value in PostgreSQL text format, using the
+// type with OID "typeOID" for conversion when needed.
+func (pk PrimaryKey) Text(ci *pgtype.ConnInfo, typeOID uint32) (string, error) {
+	var encoder pgtype.TextEncoder
+
+	switch value := pk.value.(type) {
 	case string:
-		return driver.String.ConvertValue(pk.value)
+		return value, nil
+	case pgtype.TextEncoder:
+		encoder = value
 	default:
-		return nil, fmt.Errorf("Unhandled primary key type: %v", pk.value)
+		dataType, found := ci.DataTypeForOID(typeOID)
+		if !found {
+			return fmt.Sprintf("%v", pk.value), nil
+		}
+		converted := pgtype.NewValue(dataType.Value)
+		err := converted.Set(pk.value)
+		if err != nil {
+			return "", err
+		}
+		encoder, found = converted.(pgtype.TextEncoder)
+		if !found {
+			return fmt.Sprintf("%v", pk.value), nil
+		}
+	}
+
+	text, err := encoder.EncodeText(ci, nil)
+	if err != nil {
+		return "", err
 	}
+	return string(text), nil
 }
 
 // PrimaryKeySetSlice wraps a slice of PrimaryKeySet for easy conversion
@@ -88,7 +149,30 @@ type primaryKeyRange struct {
 	count uint32
 }
 
-func extractTableSchema(ctx context.Context, conn *pgx.Conn, tablePath string) (string, error) {
+// tupleComparison creates a row value comparison between a list of columns (or expressions)
+// and the same number of query parameters, starting at parameter number "firstParameter".
+// For example: "(k1, k2) >= ($3, $4)".
+func tupleComparison(columns []string, operator string, firstParameter int) string {
+	parameters := make([]string, len(columns))
+	for i := range columns {
+		parameters[i] = fmt.Sprintf("$%d", firstParameter+i)
+	}
+	return fmt.Sprintf("(%s) %s (%s)", strings.Join(columns, ", "), operator, strings.Join(parameters, ", "))
+}
+
+// textTupleComparison works like tupleComparison, but with text parameters
+// that are cast to the given column types.
+func textTupleComparison(columns []string, types []columnType, operator string, firstParameter int) string {
+	parameters := make([]string, len(columns))
+	for i := range columns {
+		parameters[i] = fmt.Sprintf("$%d::text::%s", firstParameter+i, types[i].name)
+	}
+	return fmt.Sprintf("(%s) %s (%s)", strings.Join(columns, ", "), operator, strings.Join(parameters, ", "))
+}
+
+// extractTableSchema returns a create statement for the table. Only the listed
+// columns are included, unless the list is empty.
+func extractTableSchema(ctx context.Context, conn dbConn, tablePath string, columns []string) (string, error) {
 	namespace, table := splitTablePath(tablePath)
 
 	row := conn.QueryRow(ctx,
@@ -124,11 +208,12 @@ func extractTableSchema(ctx context.Context, conn *pgx.Conn, tablePath string) (
             and a.attrelid = c.oid
             and a.atttypid = t.oid
             and n.oid = c.relnamespace
+            and (coalesce(cardinality($3::text[]), 0) = 0 or a.attname = any($3::text[]))
         order by a.attnum
     ) as "schema"
     group by
         relname;
-    `, namespace, table)
+    `, namespace, table, columns)
 
 	var schema string
 	err := row.Scan(&schema)
@@ -138,17 +223,79 @@ func extractTableSchema(ctx context.Context, conn *pgx.Conn, tablePath string) (
 	return schema, nil
 }
 
+// columnType describes the type of a table column
+type columnType struct {
+	// SQL type name, including modifiers
+	name string
+	oid  uint32
+}
+
+// extractColumnTypes returns the types of all table columns, and the column names in table order
+func extractColumnTypes(ctx context.Context, conn dbConn, tablePath string) (map[string]columnType, []string, error) {
+	q := `--sql
+    select
+        a.attname,
+        pg_catalog.format_type(a.atttypid, a.atttypmod),
+        a.atttypid
+    from
+        pg_class c,
+        pg_attribute a,
+        pg_catalog.pg_namespace n
+    where
+        c.relname = $2
+        and n.nspname = $1
+        and a.attnum > 0
+        and not a.attisdropped
+        and a.attrelid = c.oid
+        and n.oid = c.relnamespace
+    order by a.attnum
+    ;`
+
+	result := make(map[string]columnType)
+	var columns []string
+
+	namespace, table := splitTablePath(tablePath)
+	rows, err := conn.Query(ctx, q, namespace, table)
+	if err != nil {
+		return result, columns, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var column string
+		var colType columnType
+		err = rows.Scan(&column, &colType.name, &colType.oid)
+		if err != nil {
+			return result, columns, err
+		}
+		result[column] = colType
+		columns = append(columns, column)
+	}
+
+	return result, columns, rows.Err()
+}
+
 type tableIndex struct {
 	indexName string
 	primary   bool
-	columns   []string
+	unique    bool
+	// Unique index on non-null columns, without expressions or predicates
+	identityCandidate bool
+	// Index used as replication identity instead of a primary key
+	identity bool
+	columns  []string
 }
 
-func extractTableIndices(ctx context.Context, conn *pgx.Conn, tablePath string) ([]tableIndex, error) {
+func extractTableIndices(ctx context.Context, conn dbConn, tablePath string) ([]tableIndex, error) {
 	q := `--sql
     select
         i.relname as "indexName",
         ix.indisprimary as "primary",
+        ix.indisunique as "unique",
+        ix.indisunique
+            and ix.indpred is null
+            and ix.indexprs is null
+            and bool_and(a.attnotnull) as "identityCandidate",
         array_agg(a.attname)::text[] as "columns"
     from
         pg_class t,
@@ -166,7 +313,7 @@ func extractTableIndices(ctx context.Context, conn *pgx.Conn, tablePath string)
         and n.nspname = $1
         and t.relname = $2
     group by
-    	1, 2
+    	1, 2, 3, ix.indpred is null, ix.indexprs is null
     order by
         1, 2
     ;`
@@ -182,7 +329,7 @@ func extractTableIndices(ctx context.Context, conn *pgx.Conn, tablePath string)
 
 	for rows.Next() {
 		var index tableIndex
-		err = rows.Scan(&index.indexName, &index.primary, &index.columns)
+		err = rows.Scan(&index.indexName, &index.primary, &index.unique, &index.identityCandidate, &index.columns)
 		if err != nil {
 			return result, err
 		}
@@ -192,7 +339,7 @@ func extractTableIndices(ctx context.Context, conn *pgx.Conn, tablePath string)
 	return result, nil
 }
 
-func objectExists(ctx context.Context, conn *pgx.Conn, tablePath string) (bool, error) {
+func objectExists(ctx context.Context, conn dbConn, tablePath string) (bool, error) {
 	row := conn.QueryRow(ctx, `select to_regclass($1) is not null`, tablePath)
 	var exists bool
 	err := row.Scan(&exists)
@@ -210,7 +357,65 @@ func splitTablePath(path string) (string, string) {
 	return namespace, table
 }
 
-func createTable(ctx context.Context, conn *pgx.Conn, table string, schema string) error {
+// maxIdentifierLength is the longest Postgres identifier, in bytes.
+// Longer identifiers are silently truncated.
+const maxIdentifierLength = 63
+
+// suffixedName adds a suffix to an identifier. Names that would become too long are
+// shortened, and made unique by a hash of the full name.
+func suffixedName(name string, suffix string) string {
+	if len(name)+len(suffix) <= maxIdentifierLength {
+		return name + suffix
+	}
+	hash := fmt.Sprintf("%x", md5.Sum([]byte(name)))[:8]
+	length := maxIdentifierLength - len(suffix) - len(hash) - 1
+	for length > 0 && !utf8.RuneStart(name[length]) {
+		length--
+	}
+	return name[:length] + "_" + hash + suffix
+}
+
+// dependentObjects returns the views and foreign keys depending on a table
+func dependentObjects(ctx context.Context, conn dbConn, table string) ([]string, error) {
+	rows, err := conn.Query(ctx, `--sql
+	select
+		distinct dependent.oid::regclass::text
+	from
+		pg_depend d
+		join pg_rewrite r on r.oid = d.objid
+		join pg_class dependent on dependent.oid = r.ev_class
+	where
+		d.classid = 'pg_rewrite'::regclass
+		and d.refobjid = $1::regclass
+		and dependent.oid <> $1::regclass
+	union
+	select
+		conname || ' on ' || conrelid::regclass::text
+	from
+		pg_constraint
+	where
+		contype = 'f'
+		and confrelid = $1::regclass
+		and conrelid <> $1::regclass
+	;`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects []string
+	for rows.Next() {
+		var object string
+		err = rows.Scan(&object)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	return objects, rows.Err()
+}
+
+func createTable(ctx context.Context, conn dbConn, table string, schema string) error {
 	namespace, _ := splitTablePath(table)
 	_, err := conn.Exec(ctx, fmt.Sprintf("create schema if not exists %s", namespace))
 	if err != nil {
@@ -224,7 +429,7 @@ func createTable(ctx context.Context, conn *pgx.Conn, table string, schema strin
 	return nil
 }
 
-func recreateTable(ctx context.Context, conn *pgx.Conn, table string, schema string) error {
+func recreateTable(ctx context.Context, conn dbConn, table string, schema string) error {
 	_, err := conn.Exec(ctx, fmt.Sprintf("drop table %s", table))
 	if err != nil {
 		return fmt.Errorf("failed to drop table during re-creation: %w", err)
@@ -238,19 +443,38 @@ func recreateTable(ctx context.Context, conn *pgx.Conn, table string, schema str
 	return nil
 }
 
-func applyIndices(ctx context.Context, conn *pgx.Conn, table string, indices []tableIndex) error {
+func applyIndices(ctx context.Context, conn dbConn, table string, indices []tableIndex, concurrently bool) error {
 	for _, index := range indices {
-		columns := strings.Join(index.columns, ",")
-		var directive string
-		if index.primary {
-			directive = "unique"
-		}
-		q := fmt.Sprintf("create %s index concurrently if not exists %s on %s (%s)", directive, index.indexName, table, columns)
-		_, err := conn.Exec(ctx, q)
+		err := createIndex(ctx, conn, table, index, index.indexName, concurrently)
 		if err != nil {
-			return fmt.Errorf("failed to create index: %w", err)
+			return err
 		}
 	}
 
 	return nil
 }
+
+func createIndex(ctx context.Context, conn dbConn, table string, index tableIndex, indexName string, concurrently bool) error {
+	columns := strings.Join(index.columns, ",")
+	var directive string
+	if index.primary || index.identity {
+		directive = "unique"
+	}
+	var concurrentDirective string
+	if concurrently {
+		concurrentDirective = "concurrently"
+	}
+	q := fmt.Sprintf("create %s index %s if not exists %s on %s (%s)", directive, concurrentDirective, indexName, table, columns)
+	_, err := conn.Exec(ctx, q)
+	if err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+	return nil
+}
+
+// renameTableSchema changes the table name of a create statement
+// as returned by extractTableSchema.
+func renameTableSchema(schema string, table string) string {
+	columns := schema[strings.Index(schema, "("):]
+	return fmt.Sprintf("create table %s%s", table, columns)
+}
@@ -0,0 +1,87 @@
+package sslr
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTupleComparison(t *testing.T) {
+	tests := []struct {
+		columns        []string
+		operator       string
+		firstParameter int
+		expected       string
+	}{
+		{[]string{"id"}, ">=", 1, "(id) >= ($1)"},
+		{[]string{"a", "b"}, ">=", 1, "(a, b) >= ($1, $2)"},
+		{[]string{"a", "b"}, "<=", 3, "(a, b) <= ($3, $4)"},
+		{[]string{"a", "b", "c"}, ">", 2, "(a, b, c) > ($2, $3, $4)"},
+	}
+
+	for _, test := range tests {
+		actual := tupleComparison(test.columns, test.operator, test.firstParameter)
+		if actual != test.expected {
+			t.Errorf("tupleComparison(%v, %q, %v) = %q, expected %q",
+				test.columns, test.operator, test.firstParameter, actual, test.expected)
+		}
+	}
+}
+
+func TestTextTupleComparison(t *testing.T) {
+	columns := []string{"a", "b"}
+	types := []columnType{{name: "integer"}, {name: "text"}}
+
+	actual := textTupleComparison(columns, types, "<=", 3)
+	expected := "(a, b) <= ($3::text::integer, $4::text::text)"
+	if actual != expected {
+		t.Errorf("textTupleComparison = %q, expected %q", actual, expected)
+	}
+}
+
+func TestWhereClauseFromKeyRange(t *testing.T) {
+	startKey := PrimaryKeySet{{value: 1}, {value: "y"}}
+	endKey := PrimaryKeySet{{value: 3}, {value: "x"}}
+
+	whereClause, parameters := whereClauseFromKeyRange([]string{"a", "b"}, startKey, endKey)
+
+	expected := "(a, b) >= ($1, $2) and (a, b) <= ($3, $4)"
+	if whereClause != expected {
+		t.Errorf("where clause = %q, expected %q", whereClause, expected)
+	}
+	expectedParameters := []interface{}{1, "y", 3, "x"}
+	if len(parameters) != len(expectedParameters) {
+		t.Fatalf("parameters = %v, expected %v", parameters, expectedParameters)
+	}
+	for i := range parameters {
+		if parameters[i] != expectedParameters[i] {
+			t.Errorf("parameters = %v, expected %v", parameters, expectedParameters)
+			break
+		}
+	}
+}
+
+func TestSuffixedName(t *testing.T) {
+	short := suffixedName("items", shadowSuffix)
+	if short != "items__sslr_shadow" {
+		t.Errorf("suffixedName = %q, expected items__sslr_shadow", short)
+	}
+
+	long := strings.Repeat("a", 60)
+	first := suffixedName(long+"1", shadowSuffix)
+	second := suffixedName(long+"2", shadowSuffix)
+	if len(first) > maxIdentifierLength || len(second) > maxIdentifierLength {
+		t.Errorf("suffixed names %q and %q are too long", first, second)
+	}
+	if first == second {
+		t.Errorf("suffixed names of different tables collide: %q", first)
+	}
+	if !strings.HasSuffix(first, shadowSuffix) {
+		t.Errorf("suffixed name %q lost its suffix", first)
+	}
+
+	multibyte := suffixedName(strings.Repeat("å", 40), shadowSuffix)
+	if len(multibyte) > maxIdentifierLength || !utf8.ValidString(multibyte) {
+		t.Errorf("suffixed name %q is invalid", multibyte)
+	}
+}
@@ -0,0 +1,88 @@
+package sslr
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// sink is the target side of a sync job. Sinks store table state, create target tables
+// and write synced rows. Target tables are given by target table name.
+//
+// Where clauses are source SQL, and are only used by sinks that can evaluate them.
+type sink interface {
+	// setupState prepares the sink for storing table state
+	setupState(ctx context.Context) error
+	loadState(ctx context.Context, key string) (tableState, error)
+	storeState(ctx context.Context, key string, state tableState) error
+
+	tableExists(ctx context.Context, table string) (bool, error)
+	// tableSchema returns the schema of an existing table,
+	// comparable to source schemas returned by extractTableSchema
+	tableSchema(ctx context.Context, table string) (string, error)
+	createTable(ctx context.Context, table string, definition tableDefinition) error
+	recreateTable(ctx context.Context, table string, definition tableDefinition) error
+	createIndices(ctx context.Context, table string, indices []tableIndex) error
+
+	tableLength(ctx context.Context, table string, where string) (uint64, error)
+	// keyHash calculates a hash of the hashed columns of all rows in the key range
+	keyHash(ctx context.Context, table string, primaryKeys []string, hashedColumns []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string) (string, error)
+	// sourceKeyHash calculates the hash of a source key range, comparable to keyHash.
+	// The rows and bytes read from the source are recorded in "throttle".
+	sourceKeyHash(ctx context.Context, source dbConn, throttle *throttledOperation, table string, primaryKeys []string, hashedColumns []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string) (string, error)
+
+	// applyChunk replaces or inserts rows by primary key, using the given apply strategy.
+	// "xmins" holds the source transaction id of each row.
+	applyChunk(ctx context.Context, table string, primaryKeys []string, keyTypes []columnType, columns []string, rows [][]interface{}, xmins []uint64, strategy string) error
+	// replaceRange replaces all rows in the key range with the given rows, in a single transaction
+	replaceRange(ctx context.Context, table string, primaryKeys []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string, columns []string, rows pgx.CopyFromSource) (int64, error)
+	// replaceTable deletes all rows of the table, and calls "copy" to write new rows,
+	// in a single transaction
+	replaceTable(ctx context.Context, table string, where string, copy func(target rowCopier) error) error
+
+	// close closes the sink. "runErr" is the error that ended the run, or nil if it succeeded.
+	close(ctx context.Context, runErr error)
+}
+
+// tableDefinition describes a target table to create
+type tableDefinition struct {
+	// Create statement, as returned by extractTableSchema
+	schema      string
+	columns     []string
+	columnTypes map[string]columnType
+}
+
+// rowCopier writes rows in bulk. Implemented by pgx connections and transactions.
+type rowCopier interface {
+	CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error)
+}
+
+// targetSink returns the sink of the job target. Without a configured sink,
+// the job target Postgres connection or transaction is used.
+func (job *Job) targetSink() sink {
+	if job.sink != nil {
+		return job.sink
+	}
+	return postgresSink{
+		conn:          job.target,
+		stateTable:    job.cfg.StateTableName,
+		inTransaction: job.atomicTx != nil,
+	}
+}
+
+// openSink opens the sink of a SQLite or file export target
+func (job *Job) openSink() (sink, error) {
+	connection := job.cfg.TargetConnection
+	if isSQLiteConnection(connection) {
+		sqlite, err := openSQLiteSink(job.ctx, connection, job.cfg.StateTableName)
+		if err != nil {
+			return nil, err
+		}
+		return sqlite, nil
+	}
+	export, err := openExportSink(job.ctx, connection, job.cfg.ExportFormat, job.cfg.StateTableName)
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
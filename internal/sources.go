@@ -0,0 +1,146 @@
+package sslr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/erkkah/letarette/pkg/logger"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+// With several sources configured, the same tables are synced from each source
+// into shared target tables (fan-in). Each source is synced by a separate job,
+// and target rows are told apart using a discriminator column holding the source name.
+// The discriminator column is added first in the target primary key, and all target
+// reads and writes of a source job are limited to its own rows.
+
+// runSources runs the job for each source in turn
+func (job *Job) runSources() error {
+	for _, sourceJob := range job.sourceJobs {
+		logger.Info.Printf("Syncing from source %s", sourceJob.sourceName)
+		updatedRows := sourceJob.updatedRows
+		err := sourceJob.Run()
+		job.updatedRows += sourceJob.updatedRows - updatedRows
+		if err != nil {
+			return fmt.Errorf("failed to sync from source %s: %w", sourceJob.sourceName, err)
+		}
+	}
+	return nil
+}
+
+// fanIn returns true if the job syncs from one of several sources
+func (job *Job) fanIn() bool {
+	return len(job.sourceName) > 0
+}
+
+// targetWhere adds the source discriminator condition to a where clause
+// used in the target database
+func (job *Job) targetWhere(where string) string {
+	if !job.fanIn() {
+		return where
+	}
+	condition := fmt.Sprintf("%s = '%s'",
+		pgx.Identifier{job.cfg.SourceColumn}.Sanitize(), strings.ReplaceAll(job.sourceName, "'", "''"))
+	if len(where) == 0 {
+		return condition
+	}
+	return fmt.Sprintf("(%s) and %s", where, condition)
+}
+
+// targetKeys returns the target primary keys, including the discriminator column
+func (job *Job) targetKeys(primaryKeys []string) []string {
+	if !job.fanIn() {
+		return primaryKeys
+	}
+	return append([]string{job.cfg.SourceColumn}, primaryKeys...)
+}
+
+// targetKeyTypes returns the target primary key types, including the discriminator column
+func (job *Job) targetKeyTypes(keyTypes []columnType) []columnType {
+	if !job.fanIn() {
+		return keyTypes
+	}
+	return append([]columnType{{name: "text", oid: pgtype.TextOID}}, keyTypes...)
+}
+
+// targetColumns returns the target column names of copied rows,
+// with the discriminator column added last
+func (job *Job) targetColumns(columns []string) []string {
+	if !job.fanIn() {
+		return columns
+	}
+	return append(append([]string{}, columns...), job.cfg.SourceColumn)
+}
+
+// targetRow adds the discriminator value last to a row
+func (job *Job) targetRow(values []interface{}) []interface{} {
+	if !job.fanIn() {
+		return values
+	}
+	return append(values, job.sourceName)
+}
+
+// targetSchema adds the discriminator column first to a table schema
+// as returned by extractTableSchema
+func (job *Job) targetSchema(schema string) string {
+	if !job.fanIn() {
+		return schema
+	}
+	start := strings.Index(schema, "(") + 1
+	return fmt.Sprintf("%s%s text not null,%s", schema[:start], job.cfg.SourceColumn, schema[start:])
+}
+
+// targetIndices adds the discriminator column first to identifying indices
+func (job *Job) targetIndices(indices []tableIndex) []tableIndex {
+	if !job.fanIn() {
+		return indices
+	}
+	result := make([]tableIndex, len(indices))
+	for i, index := range indices {
+		if index.primary || index.identity {
+			index.columns = append([]string{job.cfg.SourceColumn}, index.columns...)
+		}
+		result[i] = index
+	}
+	return result
+}
+
+// discriminatorSource adds the discriminator value to each row read from a source
+type discriminatorSource struct {
+	pgx.CopyFromSource
+	job *Job
+}
+
+func (job *Job) newDiscriminatorSource(source pgx.CopyFromSource) pgx.CopyFromSource {
+	if !job.fanIn() {
+		return source
+	}
+	return &discriminatorSource{
+		CopyFromSource: source,
+		job:            job,
+	}
+}
+
+func (d *discriminatorSource) Values() ([]interface{}, error) {
+	values, err := d.CopyFromSource.Values()
+	if err != nil {
+		return values, err
+	}
+	return d.job.targetRow(values), nil
+}
+
+// resetTargetTableStates clears the state of all sources syncing to a target table,
+// after the table has been re-created
+func (job *Job) resetTargetTableStates(table string) error {
+	q := fmt.Sprintf(`--sql
+	delete from %s
+	where right(table_name, length($1)) = $1
+	;`, job.cfg.StateTableName)
+
+	_, err := job.target.Exec(job.ctx, q, ":"+job.cfg.targetTable(table))
+	if err != nil {
+		return fmt.Errorf("failed to reset table states: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,727 @@
+package sslr
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+
+	// SQLite driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlitePrefix marks target connections to local SQLite files, like "sqlite:local.db"
+const sqlitePrefix = "sqlite:"
+
+// sqliteSchemaTable keeps the source schemas of created tables, for detecting schema changes
+const sqliteSchemaTable = "__sslr_schemas"
+
+// Timestamps are stored as fixed width text, to keep text order equal to time order
+const sqliteTimeFormat = "2006-01-02 15:04:05.000000Z07:00"
+
+var sqliteConnInfo = pgtype.NewConnInfo()
+
+func isSQLiteConnection(connection string) bool {
+	return strings.HasPrefix(connection, sqlitePrefix)
+}
+
+// sqliteSink writes to a local SQLite file.
+//
+// Tables in the "public" schema keep their names, other tables are prefixed by
+// their schema name, like "schema_table". Integer, floating point and binary
+// columns are stored natively, all other values are stored as text.
+//
+// Where clauses are not evaluated, since they are source SQL. Tables only hold
+// rows synced using the where clause, and are fully re-synced when it changes,
+// so the whole table is the filtered range of the source table.
+//
+// Key ranges are compared in SQLite order, which only matches source order
+// for the key types in sqliteOrderedKeyTypes, with source text keys compared
+// in the "C" collation, see sourceKeyExpressions.
+type sqliteSink struct {
+	db         *sql.DB
+	stateTable string
+}
+
+func openSQLiteSink(ctx context.Context, connection string, stateTable string) (*sqliteSink, error) {
+	db, err := sql.Open("sqlite3", strings.TrimPrefix(connection, sqlitePrefix))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer at a time
+	db.SetMaxOpenConns(1)
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open SQLite target: %w", err)
+	}
+
+	return &sqliteSink{
+		db:         db,
+		stateTable: sqliteTableName(stateTable),
+	}, nil
+}
+
+// sqliteTableName maps a Postgres table path to a SQLite table name
+func sqliteTableName(table string) string {
+	namespace, name := splitTablePath(table)
+	if namespace == "public" {
+		return name
+	}
+	return namespace + "_" + name
+}
+
+func sqliteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func sqliteIdentifiers(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = sqliteIdentifier(name)
+	}
+	return strings.Join(quoted, ",")
+}
+
+// sqliteColumnType maps a Postgres column type to a SQLite column type
+func sqliteColumnType(colType columnType) string {
+	switch colType.name {
+	case "smallint", "integer", "bigint", "boolean":
+		return "integer"
+	case "real", "double precision":
+		return "real"
+	case "bytea":
+		return "blob"
+	default:
+		return "text"
+	}
+}
+
+// sqliteOrderedKeyTypes are the key types that SQLite orders like the source.
+// Integer, floating point and binary keys are stored natively. Text is compared
+// byte by byte, and UUIDs, dates and timestamps are stored as fixed width text.
+var sqliteOrderedKeyTypes = map[uint32]bool{
+	pgtype.Int2OID:        true,
+	pgtype.Int4OID:        true,
+	pgtype.Int8OID:        true,
+	pgtype.BoolOID:        true,
+	pgtype.Float4OID:      true,
+	pgtype.Float8OID:      true,
+	pgtype.ByteaOID:       true,
+	pgtype.TextOID:        true,
+	pgtype.VarcharOID:     true,
+	pgtype.BPCharOID:      true,
+	pgtype.UUIDOID:        true,
+	pgtype.DateOID:        true,
+	pgtype.TimestampOID:   true,
+	pgtype.TimestamptzOID: true,
+}
+
+// isTextType returns true for the text types, which are compared byte by byte by SQLite
+func isTextType(colType columnType) bool {
+	switch colType.oid {
+	case pgtype.TextOID, pgtype.VarcharOID, pgtype.BPCharOID:
+		return true
+	}
+	return false
+}
+
+// sqliteAffinity returns the type affinity of a declared SQLite column type
+func sqliteAffinity(declaredType string) string {
+	declaredType = strings.ToLower(declaredType)
+	switch {
+	case strings.Contains(declaredType, "int"):
+		return "integer"
+	case strings.Contains(declaredType, "char"), strings.Contains(declaredType, "clob"), strings.Contains(declaredType, "text"):
+		return "text"
+	case declaredType == "", strings.Contains(declaredType, "blob"):
+		return "blob"
+	case strings.Contains(declaredType, "real"), strings.Contains(declaredType, "floa"), strings.Contains(declaredType, "doub"):
+		return "real"
+	default:
+		return "numeric"
+	}
+}
+
+// sqliteValue converts a value decoded by pgx to a value stored by SQLite
+func sqliteValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case nil, int64, float64, string, []byte:
+		return value
+	case int16:
+		return int64(value)
+	case int32:
+		return int64(value)
+	case int:
+		return int64(value)
+	case uint32:
+		return int64(value)
+	case uint64:
+		return int64(value)
+	case float32:
+		return float64(value)
+	case bool:
+		if value {
+			return int64(1)
+		}
+		return int64(0)
+	case time.Time:
+		return value.UTC().Format(sqliteTimeFormat)
+	case [16]byte:
+		v = pgtype.UUID{Bytes: value, Status: pgtype.Present}
+	}
+
+	if encoder, ok := v.(pgtype.TextEncoder); ok {
+		text, err := encoder.EncodeText(sqliteConnInfo, nil)
+		if err == nil {
+			if text == nil {
+				return nil
+			}
+			return string(text)
+		}
+	}
+	if stringer, ok := v.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(encoded)
+}
+
+func sqliteValues(values []interface{}) []interface{} {
+	converted := make([]interface{}, len(values))
+	for i, value := range values {
+		converted[i] = sqliteValue(value)
+	}
+	return converted
+}
+
+func (s *sqliteSink) setupState(ctx context.Context) error {
+	q := fmt.Sprintf(`--sql
+	create table if not exists %s (
+		table_name text primary key,
+		last_seen_xmin integer,
+		where_clause text,
+		checked_xid integer,
+		copy_key text,
+		copy_start_xmin integer,
+		copy_checked_xid integer
+	)
+	;`, sqliteIdentifier(s.stateTable))
+
+	_, err := s.db.ExecContext(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf(`--sql
+	create table if not exists %s (
+		table_name text primary key,
+		schema text
+	)
+	;`, sqliteSchemaTable)
+
+	_, err = s.db.ExecContext(ctx, q)
+	return err
+}
+
+func (s *sqliteSink) loadState(ctx context.Context, key string) (tableState, error) {
+	var state tableState
+	var copyKey string
+
+	q := fmt.Sprintf(`--sql
+	select
+		coalesce(last_seen_xmin, 0), coalesce(checked_xid, 0), coalesce(where_clause, ''),
+		coalesce(copy_key, ''), coalesce(copy_start_xmin, 0), coalesce(copy_checked_xid, 0)
+	from %s
+	where table_name = ?
+	;`, sqliteIdentifier(s.stateTable))
+
+	row := s.db.QueryRowContext(ctx, q, key)
+	err := row.Scan(
+		&state.lastSeenXmin, &state.checkedXid, &state.whereClause,
+		&copyKey, &state.copyStartXmin, &state.copyCheckedXid,
+	)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to load table state: %w", err)
+	}
+
+	if copyKey != "" {
+		err = json.Unmarshal([]byte(copyKey), &state.copyKey)
+		if err != nil {
+			return state, fmt.Errorf("failed to load table state: %w", err)
+		}
+	}
+
+	return state, nil
+}
+
+func (s *sqliteSink) storeState(ctx context.Context, key string, state tableState) error {
+	var copyKey interface{}
+	if state.copyKey != nil {
+		encoded, err := json.Marshal(state.copyKey)
+		if err != nil {
+			return fmt.Errorf("failed to set table state: %w", err)
+		}
+		copyKey = string(encoded)
+	}
+
+	q := fmt.Sprintf(`--sql
+	insert or replace into %s (
+		table_name, last_seen_xmin, where_clause, checked_xid,
+		copy_key, copy_start_xmin, copy_checked_xid
+	) values(?, ?, ?, ?, ?, ?, ?)
+	;`, sqliteIdentifier(s.stateTable))
+
+	_, err := s.db.ExecContext(
+		ctx, q, key, int64(state.lastSeenXmin), state.whereClause, int64(state.checkedXid),
+		copyKey, int64(state.copyStartXmin), int64(state.copyCheckedXid),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set table state: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteSink) tableExists(ctx context.Context, table string) (bool, error) {
+	var count int
+	row := s.db.QueryRowContext(ctx, "select count(*) from sqlite_master where type = 'table' and name = ?", sqliteTableName(table))
+	err := row.Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// tableSchema returns the source schema the table was created from.
+// Tables not created by SSLR have an empty schema.
+func (s *sqliteSink) tableSchema(ctx context.Context, table string) (string, error) {
+	var schema string
+	q := fmt.Sprintf("select schema from %s where table_name = ?", sqliteSchemaTable)
+	row := s.db.QueryRowContext(ctx, q, sqliteTableName(table))
+	err := row.Scan(&schema)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return schema, err
+}
+
+func (s *sqliteSink) createTable(ctx context.Context, table string, definition tableDefinition) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	name := sqliteTableName(table)
+
+	columns := make([]string, len(definition.columns))
+	for i, column := range definition.columns {
+		columns[i] = fmt.Sprintf("%s %s", sqliteIdentifier(column), sqliteColumnType(definition.columnTypes[column]))
+	}
+
+	q := fmt.Sprintf("create table %s (%s)", sqliteIdentifier(name), strings.Join(columns, ", "))
+	_, err = tx.ExecContext(ctx, q)
+	if err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+
+	q = fmt.Sprintf("insert or replace into %s (table_name, schema) values(?, ?)", sqliteSchemaTable)
+	_, err = tx.ExecContext(ctx, q, name, definition.schema)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	tx = nil
+	return nil
+}
+
+func (s *sqliteSink) recreateTable(ctx context.Context, table string, definition tableDefinition) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("drop table if exists %s", sqliteIdentifier(sqliteTableName(table))))
+	if err != nil {
+		return err
+	}
+	return s.createTable(ctx, table, definition)
+}
+
+func (s *sqliteSink) createIndices(ctx context.Context, table string, indices []tableIndex) error {
+	name := sqliteTableName(table)
+	for _, index := range indices {
+		var directive string
+		if index.primary || index.identity {
+			directive = "unique"
+		}
+		q := fmt.Sprintf(
+			"create %s index if not exists %s on %s (%s)",
+			directive, sqliteIdentifier(name+"_"+index.indexName), sqliteIdentifier(name), sqliteIdentifiers(index.columns),
+		)
+		_, err := s.db.ExecContext(ctx, q)
+		if err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the columns of a table in table order with their SQLite types,
+// and the columns of the unique index created for the table key, if any
+func (s *sqliteSink) tableColumns(ctx context.Context, table string) ([]string, map[string]string, []string, error) {
+	name := sqliteTableName(table)
+
+	rows, err := s.db.QueryContext(ctx, "select name, type from pragma_table_info(?) order by cid", name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	types := make(map[string]string)
+	for rows.Next() {
+		var column, columnType string
+		err = rows.Scan(&column, &columnType)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		columns = append(columns, column)
+		types[column] = columnType
+	}
+	if rows.Err() != nil {
+		return nil, nil, nil, rows.Err()
+	}
+	rows.Close()
+
+	var index string
+	row := s.db.QueryRowContext(ctx, `select name from pragma_index_list(?) where "unique" and origin = 'c' order by seq limit 1`, name)
+	err = row.Scan(&index)
+	if err == sql.ErrNoRows {
+		return columns, types, nil, nil
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	rows, err = s.db.QueryContext(ctx, "select name from pragma_index_info(?) order by seqno", index)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		keys = append(keys, key)
+	}
+	return columns, types, keys, rows.Err()
+}
+
+// tableLength counts all rows, since tables only hold rows matching the where clause
+func (s *sqliteSink) tableLength(ctx context.Context, table string, where string) (uint64, error) {
+	var length uint64
+	row := s.db.QueryRowContext(ctx, fmt.Sprintf("select count(*) from %s", sqliteIdentifier(sqliteTableName(table))))
+	err := row.Scan(&length)
+	return length, err
+}
+
+// sqliteKeyRange returns a where clause and parameters selecting the key range.
+// Keys are compared by the affinity of their declared types, and text keys
+// byte by byte, to match the order of source keys.
+func sqliteKeyRange(primaryKeys []string, declaredTypes map[string]string, startKey, endKey PrimaryKeySet) (string, []interface{}) {
+	keys := make([]string, len(primaryKeys))
+	placeholders := make([]string, len(primaryKeys))
+	for i, key := range primaryKeys {
+		keys[i] = sqliteIdentifier(key)
+		placeholders[i] = "?"
+		switch affinity := sqliteAffinity(declaredTypes[key]); affinity {
+		case "blob":
+		case "text":
+			keys[i] += " collate binary"
+			placeholders[i] = "cast(? as text)"
+		default:
+			placeholders[i] = fmt.Sprintf("cast(? as %s)", affinity)
+		}
+	}
+	whereClause := fmt.Sprintf(
+		"(%[1]s) >= (%[2]s) and (%[1]s) <= (%[2]s)",
+		strings.Join(keys, ","), strings.Join(placeholders, ","),
+	)
+	return whereClause, append(sqliteValues(startKey.Values()), sqliteValues(endKey.Values())...)
+}
+
+// keyRange returns a where clause and parameters selecting the key range of the table
+func (s *sqliteSink) keyRange(ctx context.Context, table string, primaryKeys []string, startKey, endKey PrimaryKeySet) (string, []interface{}, error) {
+	_, types, _, err := s.tableColumns(ctx, table)
+	if err != nil {
+		return "", nil, err
+	}
+	whereClause, queryParameters := sqliteKeyRange(primaryKeys, types, startKey, endKey)
+	return whereClause, queryParameters, nil
+}
+
+// rangeHash is an order independent hash of rows, comparable between Postgres
+// and SQLite, which may sort text keys differently
+type rangeHash struct {
+	sum   [md5.Size]byte
+	count int
+}
+
+// add adds a row of values, as converted by sqliteValue
+func (h *rangeHash) add(values []interface{}) {
+	digest := md5.New()
+	for _, value := range values {
+		switch value := value.(type) {
+		case nil:
+			digest.Write([]byte{1})
+		case []byte:
+			digest.Write([]byte(hex.EncodeToString(value)))
+		default:
+			digest.Write([]byte(fmt.Sprintf("%v", value)))
+		}
+		digest.Write([]byte{0})
+	}
+	rowSum := digest.Sum(nil)
+	for i := range h.sum {
+		h.sum[i] ^= rowSum[i]
+	}
+	h.count++
+}
+
+func (h *rangeHash) String() string {
+	if h.count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d:%s", h.count, hex.EncodeToString(h.sum[:]))
+}
+
+// keyHash hashes all rows in the key range, since tables only hold rows matching the where clause
+func (s *sqliteSink) keyHash(ctx context.Context, table string, primaryKeys []string, hashedColumns []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string) (string, error) {
+	whereClause, queryParameters, err := s.keyRange(ctx, table, primaryKeys, startKey, endKey)
+	if err != nil {
+		return "", err
+	}
+	q := fmt.Sprintf(
+		"select %s from %s where %s",
+		sqliteIdentifiers(hashedColumns), sqliteIdentifier(sqliteTableName(table)), whereClause,
+	)
+
+	rows, err := s.db.QueryContext(ctx, q, queryParameters...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var hash rangeHash
+	values := make([]interface{}, len(hashedColumns))
+	pointers := make([]interface{}, len(hashedColumns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return "", err
+		}
+		hash.add(values)
+	}
+	if rows.Err() != nil {
+		return "", rows.Err()
+	}
+
+	return hash.String(), nil
+}
+
+func (s *sqliteSink) sourceKeyHash(ctx context.Context, source dbConn, throttle *throttledOperation, table string, primaryKeys []string, hashedColumns []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string) (string, error) {
+	var extraWhereClause string
+	if len(where) > 0 {
+		extraWhereClause = "and " + where
+	}
+
+	whereClause, queryParameters := whereClauseFromKeyRange(primaryKeys, startKey, endKey)
+
+	q := fmt.Sprintf(`--sql
+	select
+		%[1]s
+	from
+		%[2]s
+	where
+		%[3]s
+		%[4]s
+	;`, strings.Join(hashedColumns, ","), table, whereClause, extraWhereClause)
+
+	rows, err := source.Query(ctx, q, queryParameters...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var hash rangeHash
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return "", err
+		}
+		throttle.record(1, rawRowSize(rows))
+		hash.add(sqliteValues(values))
+	}
+	if rows.Err() != nil {
+		return "", rows.Err()
+	}
+
+	return hash.String(), nil
+}
+
+// applyChunk inserts or replaces rows by primary key. Both apply strategies
+// behave the same, since all SQLite writes are local.
+func (s *sqliteSink) applyChunk(ctx context.Context, table string, primaryKeys []string, keyTypes []columnType, columns []string, rows [][]interface{}, xmins []uint64, strategy string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = sqliteInsert(ctx, tx, table, columns, pgx.CopyFromRows(rows))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	tx = nil
+	return nil
+}
+
+func (s *sqliteSink) replaceRange(ctx context.Context, table string, primaryKeys []string, startKey PrimaryKeySet, endKey PrimaryKeySet, where string, columns []string, rows pgx.CopyFromSource) (int64, error) {
+	whereClause, queryParameters, err := s.keyRange(ctx, table, primaryKeys, startKey, endKey)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	d := fmt.Sprintf("delete from %s where %s", sqliteIdentifier(sqliteTableName(table)), whereClause)
+	_, err = tx.ExecContext(ctx, d, queryParameters...)
+	if err != nil {
+		return 0, err
+	}
+
+	copied, err := sqliteInsert(ctx, tx, table, columns, rows)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	tx = nil
+	return copied, nil
+}
+
+func (s *sqliteSink) replaceTable(ctx context.Context, table string, where string, copy func(target rowCopier) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("delete from %s", sqliteIdentifier(sqliteTableName(table))))
+	if err != nil {
+		return fmt.Errorf("failed to delete old data: %w", err)
+	}
+
+	err = copy(sqliteCopier{tx})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	tx = nil
+	return nil
+}
+
+func (s *sqliteSink) close(ctx context.Context, runErr error) {
+	s.db.Close()
+}
+
+// sqliteCopier implements rowCopier using inserts in a SQLite transaction
+type sqliteCopier struct {
+	tx *sql.Tx
+}
+
+func (c sqliteCopier) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	return sqliteInsert(ctx, c.tx, strings.Join(tableName, "."), columnNames, rowSrc)
+}
+
+// sqliteInsert inserts or replaces all rows from "rows", returning the number of rows written
+func sqliteInsert(ctx context.Context, tx *sql.Tx, table string, columns []string, rows pgx.CopyFromSource) (int64, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+	q := fmt.Sprintf(
+		"insert or replace into %s (%s) values(%s)",
+		sqliteIdentifier(sqliteTableName(table)), sqliteIdentifiers(columns), placeholders,
+	)
+
+	stmt, err := tx.PrepareContext(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var written int64
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return written, err
+		}
+		_, err = stmt.ExecContext(ctx, sqliteValues(values)...)
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, rows.Err()
+}
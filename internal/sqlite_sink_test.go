@@ -0,0 +1,132 @@
+package sslr
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+func testSQLiteSink(t *testing.T) *sqliteSink {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sslr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := openSQLiteSink(context.Background(), sqlitePrefix+filepath.Join(dir, "test.db"), "__sslr_state")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sink.close(context.Background(), nil)
+		os.RemoveAll(dir)
+	})
+	err = sink.setupState(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+// replaceKeyRange creates a table with the given keys, replaces the key range
+// with the start key only, and returns the remaining keys
+func replaceKeyRange(t *testing.T, keyType columnType, keys []interface{}, startKey, endKey interface{}) string {
+	t.Helper()
+	ctx := context.Background()
+	sink := testSQLiteSink(t)
+
+	err := sink.createTable(ctx, "public.keys", tableDefinition{
+		columns:     []string{"id"},
+		columnTypes: map[string]columnType{"id": keyType},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.createIndices(ctx, "public.keys", []tableIndex{{indexName: "keys_pkey", columns: []string{"id"}, primary: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows [][]interface{}
+	for _, key := range keys {
+		rows = append(rows, []interface{}{key})
+	}
+	err = sink.applyChunk(ctx, "public.keys", []string{"id"}, nil, []string{"id"}, rows, make([]uint64, len(rows)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sink.replaceRange(
+		ctx, "public.keys", []string{"id"}, PrimaryKeySet{{startKey}}, PrimaryKeySet{{endKey}}, "",
+		[]string{"id"}, pgx.CopyFromRows([][]interface{}{{startKey}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := sink.db.QueryContext(ctx, "select id from keys order by id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Close()
+	var remaining []interface{}
+	for result.Next() {
+		var key interface{}
+		if err := result.Scan(&key); err != nil {
+			t.Fatal(err)
+		}
+		remaining = append(remaining, key)
+	}
+	if result.Err() != nil {
+		t.Fatal(result.Err())
+	}
+	return fmt.Sprint(remaining)
+}
+
+func TestSQLiteTextKeyRange(t *testing.T) {
+	// Byte order, like the "C" collation, sorts "a" after "Z" and "é" last
+	remaining := replaceKeyRange(t, columnType{name: "text", oid: pgtype.TextOID},
+		[]interface{}{"A", "B", "Z", "a", "é"}, "B", "Z")
+	expected := fmt.Sprint([]interface{}{"A", "B", "a", "é"})
+	if remaining != expected {
+		t.Errorf("remaining keys = %v, expected %v", remaining, expected)
+	}
+}
+
+func TestSQLiteIntegerKeyRange(t *testing.T) {
+	// Compared as text, 10 would be in the range
+	remaining := replaceKeyRange(t, columnType{name: "integer", oid: pgtype.Int4OID},
+		[]interface{}{int32(1), int32(2), int32(9), int32(10)}, int32(2), int32(9))
+	expected := fmt.Sprint([]interface{}{int64(1), int64(2), int64(10)})
+	if remaining != expected {
+		t.Errorf("remaining keys = %v, expected %v", remaining, expected)
+	}
+}
+
+func TestSQLiteKeyRangeAffinities(t *testing.T) {
+	whereClause, parameters := sqliteKeyRange(
+		[]string{"a", "b", "c"}, map[string]string{"a": "integer", "b": "text", "c": "blob"},
+		PrimaryKeySet{{int32(1)}, {"x"}, {[]byte{1}}}, PrimaryKeySet{{int32(2)}, {"y"}, {[]byte{2}}},
+	)
+	expected := `("a","b" collate binary,"c") >= (cast(? as integer),cast(? as text),?) and ("a","b" collate binary,"c") <= (cast(? as integer),cast(? as text),?)`
+	if whereClause != expected {
+		t.Errorf("where clause = %s, expected %s", whereClause, expected)
+	}
+	if len(parameters) != 6 || parameters[0] != int64(1) || parameters[4] != "y" {
+		t.Errorf("unexpected parameters %v", parameters)
+	}
+}
+
+func TestSQLiteOrderedKeyTypes(t *testing.T) {
+	if !sqliteOrderedKeyTypes[pgtype.VarcharOID] || !sqliteOrderedKeyTypes[pgtype.UUIDOID] {
+		t.Errorf("expected varchar and uuid keys to be ordered")
+	}
+	if sqliteOrderedKeyTypes[pgtype.NumericOID] {
+		t.Errorf("expected numeric keys not to be ordered")
+	}
+}
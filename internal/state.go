@@ -1,86 +1,105 @@
 package sslr
 
-import (
-	"fmt"
-
-	"github.com/jackc/pgx/v4"
-)
+// consistentState is the name used for the state of the whole job
+// when syncing from a consistent snapshot
+const consistentState = "*"
 
 type tableState struct {
+	// Epoch-aware id of the last synced source transaction.
+	// Older states stored the 32-bit row xmin, see epochAware.
 	lastSeenXmin uint64
-	whereClause  string
+	// Epoch-aware id before which all source transactions
+	// have been synced. Zero for older states.
+	checkedXid  uint64
+	whereClause string
+	// Progress of an interrupted full table copy, see copyInProgress.
+	// The text encoded primary key of the last copied row.
+	copyKey []string
+	// Xmin and checked xid to use when the copy is done
+	copyStartXmin  uint64
+	copyCheckedXid uint64
 }
 
 func (ts tableState) empty() bool {
 	return ts.lastSeenXmin == 0 && ts.whereClause == ""
 }
 
-func (job *Job) setupStateTable() error {
-
-	q := fmt.Sprintf(`--sql
-	create table if not exists %s (
-		table_name varchar(512) primary key,
-		last_seen_xmin bigint,
-		where_clause varchar
-	)
-	;`, job.cfg.StateTableName)
-
-	_, err := job.target.Exec(job.ctx, q)
-	return err
+// copyInProgress returns true if a resumable full table copy has been started
+func (ts tableState) copyInProgress() bool {
+	return ts.copyCheckedXid != 0
 }
 
-func (job *Job) getTableState(table string) (tableState, error) {
-	var state tableState
+// epochAware returns true if the state was stored using epoch-aware transaction ids.
+func (ts tableState) epochAware() bool {
+	return ts.checkedXid != 0
+}
 
-	err := job.setupStateTable()
-	if err != nil {
-		return state, fmt.Errorf("failed to setup state table: %w", err)
+// widened returns the state with a 32-bit last seen xmin of older states
+// converted to an epoch-aware id, using "reference" as reference id
+func (ts tableState) widened(reference uint64) tableState {
+	if !ts.epochAware() {
+		ts.lastSeenXmin = widenXid(uint32(ts.lastSeenXmin), reference)
 	}
+	return ts
+}
 
-	q := fmt.Sprintf(`--sql
-	select last_seen_xmin, coalesce(where_clause, '')
-	from %s
-	where table_name = $1
-	;`, job.cfg.StateTableName)
-
-	row := job.target.QueryRow(job.ctx, q, table)
-	err = row.Scan(&state.lastSeenXmin, &state.whereClause)
-	if err == pgx.ErrNoRows {
-		return state, nil
+// stateKey returns the state table key for a source table. Table states are
+// stored by target table name, so that each target table has its own state.
+// When syncing from several sources, keys are prefixed by the source name.
+func (job *Job) stateKey(table string) string {
+	key := table
+	if table != consistentState {
+		key = job.cfg.targetTable(table)
 	}
-	if err != nil {
-		return state, fmt.Errorf("failed to load table state: %w", err)
+	if job.fanIn() {
+		key = job.sourceName + ":" + key
 	}
+	return key
+}
+
+func (job *Job) setupStateTable() error {
+	return job.targetSink().setupState(job.ctx)
+}
 
-	return state, nil
+func (job *Job) getTableState(table string) (tableState, error) {
+	return job.targetSink().loadState(job.ctx, job.stateKey(table))
 }
 
 func (job *Job) setTableState(table string, state tableState) error {
-	err := job.setupStateTable()
-	if err != nil {
-		return fmt.Errorf("failed to setup state table: %w", err)
+	return job.targetSink().storeState(job.ctx, job.stateKey(table), state)
+}
+
+// writeTableState writes table state using the given target connection or transaction
+func (job *Job) writeTableState(target dbConn, table string, state tableState) error {
+	sink := postgresSink{
+		conn:       target,
+		stateTable: job.cfg.StateTableName,
 	}
+	return sink.storeState(job.ctx, job.stateKey(table), state)
+}
 
-	q := fmt.Sprintf(`--sql
-	insert into %s (table_name, last_seen_xmin, where_clause) values($1, $2, $3)
-	on conflict (table_name)
-	do update set last_seen_xmin = $2, where_clause = $3
-	;`, job.cfg.StateTableName)
+func (job *Job) setTableXminState(table string, xmin uint64) error {
+	state, err := job.getTableState(table)
+	if err != nil {
+		return err
+	}
 
-	_, err = job.target.Exec(job.ctx, q, table, state.lastSeenXmin, state.whereClause)
+	state.lastSeenXmin = xmin
+	err = job.setTableState(table, state)
 	if err != nil {
-		return fmt.Errorf("failed to set table state: %w", err)
+		return err
 	}
 	return nil
 }
 
-func (job *Job) setTableXminState(table string, xmin uint64) error {
+func (job *Job) setTableCheckedState(table string, lastSeenXmin uint64, checkedXid uint64) error {
 	state, err := job.getTableState(table)
 	if err != nil {
 		return err
 	}
 
-	state.lastSeenXmin = xmin
+	state.lastSeenXmin = lastSeenXmin
+	state.checkedXid = checkedXid
 	err = job.setTableState(table, state)
 	if err != nil {
 		return err
@@ -101,3 +120,12 @@ func (job *Job) setTableWhereState(table string, where string) error {
 	}
 	return nil
 }
+
+// setConsistentState records the source snapshot all tables were synced from
+func (job *Job) setConsistentState() error {
+	txids, err := getSourceTxids(job.ctx, job.source)
+	if err != nil {
+		return err
+	}
+	return job.setTableCheckedState(consistentState, txids.xmin-1, txids.xmin)
+}
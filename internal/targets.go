@@ -0,0 +1,172 @@
+package sslr
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/erkkah/letarette/pkg/logger"
+	"github.com/jackc/pgx/v4"
+)
+
+// With several targets configured, each target is synced using a copy of the job
+// with its own target connection (fan-out). Updated rows are read once from the source,
+// and applied to all targets. Since table state is kept in each target, targets
+// can lag behind each other.
+
+// jobTarget is one of several sync targets
+type jobTarget struct {
+	name             string
+	connection       string
+	conn             *pgx.Conn
+	validationStatus map[string]ValidationStatus
+	forceSync        map[string]bool
+	// Set when the target has failed, and is skipped for the rest of the run
+	failed error
+}
+
+// targetChunkBacklog is the number of read chunks that can be queued for each target,
+// before a target that cannot keep up is left behind, to be caught up separately
+const targetChunkBacklog = 4
+
+// fanOut returns true if the job syncs to several targets
+func (job *Job) fanOut() bool {
+	return len(job.targets) > 0
+}
+
+// connectTargets connects to all targets that have not failed.
+// Targets failing to connect are skipped.
+func (job *Job) connectTargets() error {
+	targets := make([]*jobTarget, len(job.targets))
+	connected := 0
+	for i, target := range job.targets {
+		connectedTarget := *target
+		targets[i] = &connectedTarget
+		if target.failed != nil {
+			continue
+		}
+		connectedTarget.conn, connectedTarget.failed = pgx.Connect(job.ctx, target.connection)
+		if connectedTarget.failed != nil {
+			logger.Error.Printf("Failed to connect to target %s, skipping it: %v", target.name, connectedTarget.failed)
+		} else {
+			connected++
+		}
+	}
+	job.targets = targets
+	if connected == 0 {
+		return fmt.Errorf("failed to connect to any target")
+	}
+	return nil
+}
+
+func (job *Job) closeTargets() {
+	for _, target := range job.targets {
+		if target.conn != nil {
+			target.conn.Close(job.ctx)
+		}
+	}
+}
+
+// withTarget returns a copy of the job syncing to a single target
+func (job *Job) withTarget(target *jobTarget) *Job {
+	targetJob := *job
+	targetJob.cfg.TargetConnection = target.connection
+	targetJob.cfg.Targets = nil
+	targetJob.targets = nil
+	targetJob.targetName = target.name
+	targetJob.targetConn = target.conn
+	targetJob.target = target.conn
+	targetJob.validationStatus = target.validationStatus
+	targetJob.forceSync = target.forceSync
+	targetJob.updatedRows = 0
+	return &targetJob
+}
+
+// eachTarget calls "fn" with the job itself, or when syncing to several targets,
+// with a job for each target that has not failed. Failing targets are logged and
+// skipped for the rest of the run, so that they do not block the other targets.
+// Fails when all targets have failed.
+func (job *Job) eachTarget(fn func(target *Job) error) error {
+	if !job.fanOut() {
+		return fn(job)
+	}
+
+	var lastError error
+	for _, target := range job.targets {
+		if target.failed != nil {
+			lastError = target.failed
+			continue
+		}
+		targetJob := job.withTarget(target)
+		err := fn(targetJob)
+		job.updatedRows += targetJob.updatedRows
+		if err != nil {
+			logger.Error.Printf("Target %s failed, skipping it for the rest of the run: %v", target.name, err)
+			target.failed = err
+			lastError = err
+		}
+	}
+	for _, target := range job.targets {
+		if target.failed == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("all targets failed, last error: %w", lastError)
+}
+
+// eachTargetConcurrently is like eachTarget, but calls "fn" for all targets at the same time,
+// so that a slow target does not hold back the others. Each target job except the first
+// gets its own source connection, reading from the consistent snapshot when there is one.
+func (job *Job) eachTargetConcurrently(fn func(target *Job) error) error {
+	if !job.fanOut() {
+		return fn(job)
+	}
+
+	var targets []*jobTarget
+	var targetJobs []*Job
+	var lastError error
+	for _, target := range job.targets {
+		if target.failed != nil {
+			lastError = target.failed
+			continue
+		}
+		targetJob := job.withTarget(target)
+		if len(targetJobs) > 0 {
+			err := targetJob.connectSource()
+			if err != nil {
+				logger.Error.Printf("Target %s failed, skipping it for the rest of the run: %v", target.name, err)
+				target.failed = fmt.Errorf("failed to connect to source: %w", err)
+				lastError = target.failed
+				continue
+			}
+			defer targetJob.source.Close(job.ctx)
+		}
+		targets = append(targets, target)
+		targetJobs = append(targetJobs, targetJob)
+	}
+
+	errs := make([]error, len(targetJobs))
+	var wg sync.WaitGroup
+	for i, targetJob := range targetJobs {
+		wg.Add(1)
+		go func(i int, targetJob *Job) {
+			defer wg.Done()
+			errs[i] = fn(targetJob)
+		}(i, targetJob)
+	}
+	wg.Wait()
+
+	for i, target := range targets {
+		job.updatedRows += targetJobs[i].updatedRows
+		if errs[i] != nil {
+			logger.Error.Printf("Target %s failed, skipping it for the rest of the run: %v", target.name, errs[i])
+			target.failed = errs[i]
+			lastError = errs[i]
+		}
+	}
+	for _, target := range job.targets {
+		if target.failed == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("all targets failed, last error: %w", lastError)
+}
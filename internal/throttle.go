@@ -1,13 +1,76 @@
 package sslr
 
 import (
+	"math"
+	"sync"
 	"time"
 )
 
-type throttledOperation struct {
-	name             string
+// throttleBudget tracks time spent in the source database, shared
+// by all throttled operations of a job
+type throttleBudget struct {
+	sync.Mutex
 	level            float64
+	maxLevel         float64 // Configured level, the adaptive throttle stays at or below it
 	startTime        time.Time
 	totalJobDuration time.Duration
-	jobStartTime     time.Time
+	// Rate limits, nil when not limited
+	rowLimit  *tokenBucket
+	byteLimit *tokenBucket
+}
+
+type throttledOperation struct {
+	name         string
+	budget       *throttleBudget
+	level        float64
+	jobStartTime time.Time
+	// Rows and bytes read from streams, not yet consumed
+	recordedRows  uint64
+	recordedBytes uint64
+}
+
+// record accounts for rows and bytes read from a stream without waiting, so that
+// no source query or target transaction is kept open while waiting for rate limits.
+// The recorded amounts are consumed by consumeRecorded, after the stream is done.
+func (t *throttledOperation) record(rows uint64, bytes uint64) {
+	t.recordedRows += rows
+	t.recordedBytes += bytes
+}
+
+// consumeRecorded consumes the amounts recorded since the last call, see consume.
+func (t *throttledOperation) consumeRecorded() {
+	t.consume(t.recordedRows, t.recordedBytes)
+	t.recordedRows = 0
+	t.recordedBytes = 0
+}
+
+// tokenBucket limits the rate of a consumed resource, allowing bursts
+// of up to one second's worth
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   rate,
+		tokens: rate,
+	}
+}
+
+// reserve takes "amount" tokens, returning how long to wait before using them
+func (b *tokenBucket) reserve(amount float64, now time.Time) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	b.tokens -= amount
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
 }
@@ -1,8 +1,15 @@
-//+build nothrottle
+//go:build nothrottle
+// +build nothrottle
 
 package sslr
 
-func newThrottle(name string, percentage float64) *throttledOperation {
+import "context"
+
+func newThrottleBudget(percentage float64, rowsPerSecond float64, bytesPerSecond float64) *throttleBudget {
+	return &throttleBudget{}
+}
+
+func newThrottle(name string, budget *throttleBudget, percentage float64) *throttledOperation {
 	return &throttledOperation{}
 }
 
@@ -11,3 +18,9 @@ func (t *throttledOperation) start() {}
 func (t *throttledOperation) end() {}
 
 func (t *throttledOperation) wait() {}
+
+func (t *throttledOperation) consume(rows uint64, bytes uint64) {}
+
+func (job *Job) startAdaptiveThrottle(ctx context.Context) (func(), error) {
+	return func() {}, nil
+}
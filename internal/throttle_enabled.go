@@ -1,4 +1,5 @@
-//+build !nothrottle
+//go:build !nothrottle
+// +build !nothrottle
 
 package sslr
 
@@ -9,39 +10,95 @@ import (
 	"github.com/erkkah/letarette/pkg/logger"
 )
 
-func newThrottle(name string, percentage float64) *throttledOperation {
-	logger.Debug.Printf("Created new throttle %q at %v%%", name, percentage)
+func throttleLevel(percentage float64) float64 {
+	return math.Max(1, math.Min(percentage, 100)) / 100
+}
+
+func newThrottleBudget(percentage float64, rowsPerSecond float64, bytesPerSecond float64) *throttleBudget {
+	level := throttleLevel(percentage)
+	return &throttleBudget{
+		level:     level,
+		maxLevel:  level,
+		rowLimit:  newTokenBucket(rowsPerSecond),
+		byteLimit: newTokenBucket(bytesPerSecond),
+	}
+}
+
+// newThrottle creates a throttled operation using the given budget. The operation
+// is throttled at "percentage", scaled by any adaptive throttle adjustments.
+func newThrottle(name string, budget *throttleBudget, percentage float64) *throttledOperation {
+	level := throttleLevel(percentage)
+	logger.Debug.Printf("Created new throttle %q at %v%%", name, level*100)
 	return &throttledOperation{
-		name:  name,
-		level: math.Max(1, math.Min(percentage, 100)) / 100,
+		name:   name,
+		budget: budget,
+		level:  level,
 	}
 }
 
 func (t *throttledOperation) start() {
 	logger.Debug.Printf("Starting %s", t.name)
 	t.jobStartTime = time.Now()
-	if t.startTime.IsZero() {
-		t.startTime = t.jobStartTime
+
+	t.budget.Lock()
+	defer t.budget.Unlock()
+	if t.budget.startTime.IsZero() {
+		t.budget.startTime = t.jobStartTime
 	}
 }
 
 func (t *throttledOperation) end() {
 	logger.Debug.Printf("Stopped %s", t.name)
-	t.totalJobDuration += time.Since(t.jobStartTime)
+
+	t.budget.Lock()
+	defer t.budget.Unlock()
+	t.budget.totalJobDuration += time.Since(t.jobStartTime)
 }
 
 func (t *throttledOperation) wait() {
-	totalDuration := time.Since(t.startTime)
-	utilization := float64(t.totalJobDuration.Milliseconds())
+	t.budget.Lock()
+	totalDuration := time.Since(t.budget.startTime)
+	utilization := float64(t.budget.totalJobDuration.Milliseconds())
+	level := t.level * t.budget.level / t.budget.maxLevel
+	t.budget.Unlock()
+
 	logger.Debug.Printf("Utilization %.2f%%", 100*utilization/float64(totalDuration.Milliseconds()))
-	if t.level >= 1 {
+	if level >= 1 {
 		return
 	}
 
-	utilizationLimit := float64(totalDuration.Milliseconds()) * t.level
+	utilizationLimit := float64(totalDuration.Milliseconds()) * level
 	if utilization > utilizationLimit {
 		waitTime := time.Duration(2*(utilization-utilizationLimit)) * time.Millisecond
-		logger.Debug.Printf("Waiting %v to keep utilization at %.2f%%", waitTime, t.level*100)
+		logger.Debug.Printf("Waiting %v to keep utilization at %.2f%%", waitTime, level*100)
+		time.Sleep(waitTime)
+	}
+}
+
+// consume accounts for rows and bytes read from the source, waiting as needed
+// to stay within the rate limits. Time spent waiting is not counted as
+// time spent in the source database.
+func (t *throttledOperation) consume(rows uint64, bytes uint64) {
+	if t.budget.rowLimit == nil && t.budget.byteLimit == nil {
+		return
+	}
+
+	t.budget.Lock()
+	now := time.Now()
+	var waitTime time.Duration
+	if t.budget.rowLimit != nil {
+		waitTime = t.budget.rowLimit.reserve(float64(rows), now)
+	}
+	if t.budget.byteLimit != nil {
+		byteWait := t.budget.byteLimit.reserve(float64(bytes), now)
+		if byteWait > waitTime {
+			waitTime = byteWait
+		}
+	}
+	t.budget.Unlock()
+
+	if waitTime > 0 {
 		time.Sleep(waitTime)
+		t.jobStartTime = t.jobStartTime.Add(waitTime)
 	}
 }
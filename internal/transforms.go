@@ -0,0 +1,280 @@
+package sslr
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Column transform types
+const (
+	transformHash         = "hash"
+	transformRedact       = "redact"
+	transformFakeEmail    = "fakeEmail"
+	transformFakeName     = "fakeName"
+	transformNull         = "null"
+	transformTruncateDate = "truncateDate"
+)
+
+func (t ColumnTransform) validate() error {
+	switch t.Type {
+	case transformHash, transformRedact, transformFakeEmail, transformFakeName, transformNull:
+	case transformTruncateDate:
+		switch t.Unit {
+		case "", "day", "month", "year":
+		default:
+			return fmt.Errorf("unknown date truncation unit %q", t.Unit)
+		}
+	default:
+		return fmt.Errorf("unknown transform type %q", t.Type)
+	}
+	return nil
+}
+
+// validateColumnType checks that the transform can produce values of the column type.
+// Transforms with fixed length results need to fit a declared column length.
+func (t ColumnTransform) validateColumnType(colType columnType) error {
+	switch t.Type {
+	case transformHash, transformRedact, transformFakeEmail, transformFakeName:
+		isText := false
+		for _, textType := range []string{"text", "character varying", "character", "citext"} {
+			if strings.HasPrefix(colType.name, textType) {
+				isText = true
+			}
+		}
+		if !isText {
+			return fmt.Errorf("transform %q needs a text column, not %q", t.Type, colType.name)
+		}
+		maxLength := columnLength(colType)
+		if maxLength == 0 {
+			return nil
+		}
+		var length int
+		switch t.Type {
+		case transformHash:
+			length = hex.EncodedLen(sha256.Size)
+		case transformRedact:
+			length = utf8.RuneCountInString(t.redactedValue())
+		}
+		if length > maxLength {
+			return fmt.Errorf("transform %q produces %d characters, which do not fit %q", t.Type, length, colType.name)
+		}
+	case transformTruncateDate:
+		if strings.HasPrefix(colType.name, "date") || strings.HasPrefix(colType.name, "timestamp") {
+			return nil
+		}
+		return fmt.Errorf("transform %q needs a date or timestamp column, not %q", t.Type, colType.name)
+	}
+	return nil
+}
+
+var columnLengthPattern = regexp.MustCompile(`^character(?: varying)?\((\d+)\)`)
+
+// columnLength returns the declared length of a character column, or zero if not limited
+func columnLength(colType columnType) int {
+	match := columnLengthPattern.FindStringSubmatch(colType.name)
+	if match == nil {
+		return 0
+	}
+	length, _ := strconv.Atoi(match[1])
+	return length
+}
+
+// apply transforms a single value. Transforms are deterministic, so
+// repeated syncs produce the same values. Fake values are shortened
+// to at most "maxLength" characters, unless zero.
+func (t ColumnTransform) apply(value interface{}, maxLength int) interface{} {
+	if value == nil || t.Type == transformNull {
+		return nil
+	}
+
+	switch t.Type {
+	case transformHash:
+		digest := t.digest(value)
+		return hex.EncodeToString(digest[:])
+	case transformRedact:
+		return t.redactedValue()
+	case transformFakeEmail:
+		return t.fakeEmail(textValue(value), maxLength)
+	case transformFakeName:
+		return truncateText(t.fakeName(textValue(value)), maxLength)
+	case transformTruncateDate:
+		timestamp, ok := value.(time.Time)
+		if !ok {
+			return value
+		}
+		year, month, day := timestamp.Date()
+		switch t.Unit {
+		case "year":
+			month, day = 1, 1
+		case "month":
+			day = 1
+		}
+		return time.Date(year, month, day, 0, 0, 0, 0, timestamp.Location())
+	}
+	return value
+}
+
+func (t ColumnTransform) redactedValue() string {
+	if len(t.Value) > 0 {
+		return t.Value
+	}
+	return "REDACTED"
+}
+
+func (t ColumnTransform) digest(value interface{}) [sha256.Size]byte {
+	return sha256.Sum256([]byte(t.Salt + textValue(value)))
+}
+
+// fakeEmail replaces the local part of an email address with a fake one, keeping the domain.
+// Values without a domain get the domain example.com. The local part is shortened
+// to make the address fit in "maxLength" characters, unless zero.
+func (t ColumnTransform) fakeEmail(email string, maxLength int) string {
+	domain := "example.com"
+	if at := strings.LastIndex(email, "@"); at >= 0 && at < len(email)-1 {
+		domain = email[at+1:]
+	}
+
+	digest := t.digest(email)
+	name := fakeWord(fakeFirstNames, digest[0:8]) + "." + fakeWord(fakeLastNames, digest[8:16])
+	local := fmt.Sprintf("%s.%s", strings.ToLower(name), hex.EncodeToString(digest[16:18]))
+	if maxLength > 0 {
+		localLength := maxLength - utf8.RuneCountInString(domain) - 1
+		if localLength < 1 {
+			return truncateText(local, maxLength)
+		}
+		local = strings.TrimRight(truncateText(local, localLength), ".")
+	}
+	return local + "@" + domain
+}
+
+// truncateText shortens a text to at most "maxLength" characters, unless zero
+func truncateText(text string, maxLength int) string {
+	if maxLength == 0 || utf8.RuneCountInString(text) <= maxLength {
+		return text
+	}
+	return string([]rune(text)[:maxLength])
+}
+
+// fakeName replaces each word of a name with a fake name,
+// keeping the number of words and their capitalization.
+func (t ColumnTransform) fakeName(name string) string {
+	words := strings.Fields(name)
+	fakes := make([]string, len(words))
+	for i, word := range words {
+		digest := sha256.Sum256([]byte(fmt.Sprintf("%s%d:%s", t.Salt, i, word)))
+		names := fakeLastNames
+		if i == 0 && len(words) > 1 {
+			names = fakeFirstNames
+		}
+		fake := fakeWord(names, digest[:8])
+		runes := []rune(word)
+		switch {
+		case strings.ToUpper(word) == word && len(runes) > 1:
+			fake = strings.ToUpper(fake)
+		case unicode.IsLower(runes[0]):
+			fake = strings.ToLower(fake)
+		}
+		fakes[i] = fake
+	}
+	return strings.Join(fakes, " ")
+}
+
+func fakeWord(words []string, digest []byte) string {
+	return words[binary.BigEndian.Uint64(digest)%uint64(len(words))]
+}
+
+func textValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+var fakeFirstNames = []string{
+	"Alex", "Billie", "Charlie", "Dana", "Eli", "Frankie", "Gale", "Harper",
+	"Indy", "Jamie", "Kai", "Lee", "Morgan", "Noa", "Oakley", "Parker",
+	"Quinn", "Riley", "Sam", "Taylor", "Uma", "Val", "Wren", "Yael",
+}
+
+var fakeLastNames = []string{
+	"Andersson", "Baker", "Carter", "Dahl", "Evans", "Fischer", "Garcia", "Hansen",
+	"Ito", "Jensen", "Kowalski", "Lind", "Moreau", "Nilsson", "Olsen", "Petrov",
+	"Quist", "Rossi", "Smith", "Tanaka", "Ulrich", "Virtanen", "Weber", "Young",
+}
+
+// rowTransformer applies the column transforms of a table to rows
+type rowTransformer struct {
+	indices    []int
+	transforms []ColumnTransform
+	// Declared column lengths, zero when not limited
+	lengths []int
+}
+
+// rowTransformer returns a transformer for rows with the given columns,
+// or nil if the table has no transforms.
+func (job *Job) rowTransformer(table string, columns []string) *rowTransformer {
+	transforms := job.cfg.tableSettings(table).Transforms
+	if len(transforms) == 0 {
+		return nil
+	}
+
+	var transformer rowTransformer
+	for i, column := range columns {
+		if transform, found := transforms[column]; found {
+			transformer.indices = append(transformer.indices, i)
+			transformer.transforms = append(transformer.transforms, transform)
+			transformer.lengths = append(transformer.lengths, columnLength(job.columnTypes[table][column]))
+		}
+	}
+	return &transformer
+}
+
+// apply transforms a row in place
+func (rt *rowTransformer) apply(values []interface{}) {
+	if rt == nil {
+		return
+	}
+	for i, index := range rt.indices {
+		values[index] = rt.transforms[i].apply(values[index], rt.lengths[i])
+	}
+}
+
+// transformingSource applies column transforms to rows read from a source
+type transformingSource struct {
+	pgx.CopyFromSource
+	transformer *rowTransformer
+}
+
+func newTransformingSource(source pgx.CopyFromSource, transformer *rowTransformer) pgx.CopyFromSource {
+	if transformer == nil {
+		return source
+	}
+	return &transformingSource{
+		CopyFromSource: source,
+		transformer:    transformer,
+	}
+}
+
+func (t *transformingSource) Values() ([]interface{}, error) {
+	values, err := t.CopyFromSource.Values()
+	if err == nil {
+		t.transformer.apply(values)
+	}
+	return values, err
+}
@@ -0,0 +1,166 @@
+package sslr
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestColumnTransformValidation(t *testing.T) {
+	tests := []struct {
+		transform ColumnTransform
+		column    string
+		valid     bool
+	}{
+		{ColumnTransform{Type: transformHash}, "text", true},
+		{ColumnTransform{Type: transformHash}, "character varying", true},
+		{ColumnTransform{Type: transformHash}, "character varying(64)", true},
+		{ColumnTransform{Type: transformHash}, "character varying(63)", false},
+		{ColumnTransform{Type: transformHash}, "character(10)", false},
+		{ColumnTransform{Type: transformHash}, "integer", false},
+		{ColumnTransform{Type: transformRedact}, "character(8)", true},
+		{ColumnTransform{Type: transformRedact}, "character(7)", false},
+		{ColumnTransform{Type: transformRedact, Value: "-"}, "character(1)", true},
+		{ColumnTransform{Type: transformFakeEmail}, "character varying(20)", true},
+		{ColumnTransform{Type: transformFakeName}, "citext", true},
+		{ColumnTransform{Type: transformFakeName}, "jsonb", false},
+		{ColumnTransform{Type: transformNull}, "integer", true},
+		{ColumnTransform{Type: transformTruncateDate}, "date", true},
+		{ColumnTransform{Type: transformTruncateDate}, "timestamp with time zone", true},
+		{ColumnTransform{Type: transformTruncateDate}, "text", false},
+	}
+
+	for _, test := range tests {
+		err := test.transform.validateColumnType(columnType{name: test.column})
+		if (err == nil) != test.valid {
+			t.Errorf("transform %q on %q: error %v, expected valid %v", test.transform.Type, test.column, err, test.valid)
+		}
+	}
+
+	for _, transform := range []ColumnTransform{
+		{Type: "scramble"},
+		{Type: transformTruncateDate, Unit: "week"},
+	} {
+		if transform.validate() == nil {
+			t.Errorf("transform %+v validated, expected error", transform)
+		}
+	}
+}
+
+func TestColumnLength(t *testing.T) {
+	tests := map[string]int{
+		"character varying(20)": 20,
+		"character(3)":          3,
+		"character varying":     0,
+		"text":                  0,
+		"numeric(10,2)":         0,
+	}
+	for name, expected := range tests {
+		if length := columnLength(columnType{name: name}); length != expected {
+			t.Errorf("columnLength(%q) = %v, expected %v", name, length, expected)
+		}
+	}
+}
+
+func TestColumnTransforms(t *testing.T) {
+	salted := func(transformType string) ColumnTransform {
+		return ColumnTransform{Type: transformType, Salt: "salt"}
+	}
+
+	hash := salted(transformHash).apply("secret", 0).(string)
+	if len(hash) != 64 || hash == salted(transformHash).apply("other", 0) {
+		t.Errorf("unexpected hash %q", hash)
+	}
+	if hash == (ColumnTransform{Type: transformHash, Salt: "pepper"}).apply("secret", 0) {
+		t.Error("hash does not depend on salt")
+	}
+
+	if value := salted(transformRedact).apply("secret", 0); value != "REDACTED" {
+		t.Errorf("redacted value %q", value)
+	}
+	if value := (ColumnTransform{Type: transformRedact, Value: "-"}).apply("secret", 0); value != "-" {
+		t.Errorf("redacted value %q", value)
+	}
+	if value := salted(transformNull).apply("secret", 0); value != nil {
+		t.Errorf("null transform returned %v", value)
+	}
+	if value := salted(transformHash).apply(nil, 0); value != nil {
+		t.Errorf("transformed null to %v", value)
+	}
+
+	date := time.Date(2020, 10, 20, 13, 14, 15, 0, time.UTC)
+	dates := map[string]time.Time{
+		"":      time.Date(2020, 10, 20, 0, 0, 0, 0, time.UTC),
+		"month": time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC),
+		"year":  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for unit, expected := range dates {
+		truncated := ColumnTransform{Type: transformTruncateDate, Unit: unit}.apply(date, 0)
+		if !truncated.(time.Time).Equal(expected) {
+			t.Errorf("truncated to %q = %v, expected %v", unit, truncated, expected)
+		}
+	}
+}
+
+func TestFakeEmail(t *testing.T) {
+	transform := ColumnTransform{Type: transformFakeEmail, Salt: "salt"}
+
+	email := transform.apply("Jane.Doe@corp.example.org", 0).(string)
+	if !strings.HasSuffix(email, "@corp.example.org") || strings.HasPrefix(email, "jane.doe@") {
+		t.Errorf("unexpected fake email %q", email)
+	}
+	if transform.apply("Jane.Doe@corp.example.org", 0) != email {
+		t.Error("fake email is not deterministic")
+	}
+	if transform.apply("jd@corp.example.org", 0) == email {
+		t.Error("different addresses got the same fake email")
+	}
+
+	if email := transform.apply("not an address", 0).(string); !strings.HasSuffix(email, "@example.com") {
+		t.Errorf("fake email %q without domain, expected example.com", email)
+	}
+
+	// The original address fits the column, so the fake one can too
+	for _, maxLength := range []int{30, 20, 19} {
+		short := transform.apply("jd@corp.example.org", maxLength).(string)
+		if utf8.RuneCountInString(short) > maxLength {
+			t.Errorf("fake email %q is longer than %v", short, maxLength)
+		}
+		at := strings.Index(short, "@")
+		if at < 1 || short[at+1:] != "corp.example.org" || strings.HasSuffix(short[:at], ".") {
+			t.Errorf("shortened fake email %q is not a valid address", short)
+		}
+	}
+}
+
+func TestFakeName(t *testing.T) {
+	transform := ColumnTransform{Type: transformFakeName, Salt: "salt"}
+
+	tests := []struct {
+		name  string
+		check func(string) bool
+	}{
+		{"Jane Doe", func(fake string) bool {
+			words := strings.Fields(fake)
+			return len(words) == 2 && words[0] != "Jane" && strings.Title(fake) == fake
+		}},
+		{"jane", func(fake string) bool { return strings.ToLower(fake) == fake }},
+		{"JANE DOE SMITH", func(fake string) bool {
+			return len(strings.Fields(fake)) == 3 && strings.ToUpper(fake) == fake
+		}},
+	}
+	for _, test := range tests {
+		fake := transform.apply(test.name, 0).(string)
+		if !test.check(fake) {
+			t.Errorf("unexpected fake name %q for %q", fake, test.name)
+		}
+		if transform.apply(test.name, 0) != fake {
+			t.Errorf("fake name for %q is not deterministic", test.name)
+		}
+	}
+
+	if fake := transform.apply("Jane Doe", 4).(string); utf8.RuneCountInString(fake) > 4 {
+		t.Errorf("fake name %q is longer than 4", fake)
+	}
+}
@@ -2,8 +2,10 @@ package sslr
 
 import (
 	"context"
+	"crypto/md5"
 	"errors"
 	"fmt"
+	"reflect"
 	"strings"
 
 	"github.com/erkkah/letarette/pkg/logger"
@@ -14,14 +16,59 @@ type updateRange struct {
 	fullTable bool
 	startXmin uint64
 	endXmin   uint64
+	// Source transaction ids at the time the range was fetched
+	txids sourceTxids
 }
 
 func (u updateRange) empty() bool {
 	return u.startXmin > u.endXmin
 }
 
-func (job *Job) getUpdateRange(table string, where string) (updateRange, error) {
-	var resultRange updateRange
+// sourceRange is the range of source rows to sync, shared by all targets
+type sourceRange struct {
+	endXmin uint64
+	length  uint64
+	txids   sourceTxids
+}
+
+func (job *Job) getSourceRange(table string, where string) (sourceRange, error) {
+	var resultRange sourceRange
+
+	txids, err := getSourceTxids(job.ctx, job.source)
+	if err != nil {
+		return resultRange, err
+	}
+	resultRange.txids = txids
+
+	var whereClause string
+	if len(where) > 0 {
+		whereClause = "where " + where
+	}
+	q := fmt.Sprintf(`--sql
+	select
+		count(*),
+		coalesce(max(%[1]s) filter (where %[2]s), 0)
+	from
+		%[3]s
+	%[4]s
+	;`, widenedXminExpression(1), normalXminCondition, table, whereClause)
+	row := job.source.QueryRow(job.ctx, q, txids.xmax)
+
+	err = row.Scan(&resultRange.length, &resultRange.endXmin)
+	if err != nil {
+		return resultRange, err
+	}
+	return resultRange, nil
+}
+
+// getUpdateRange returns the range of source rows to sync to the target,
+// based on the target table state.
+func (job *Job) getUpdateRange(table string, where string, source sourceRange) (updateRange, error) {
+	resultRange := updateRange{
+		endXmin: source.endXmin,
+		txids:   source.txids,
+	}
+	txids := source.txids
 
 	if _, ok := job.forceSync[table]; ok {
 		resultRange.fullTable = true
@@ -30,45 +77,226 @@ func (job *Job) getUpdateRange(table string, where string) (updateRange, error)
 		if err != nil {
 			return resultRange, err
 		}
-		if state.lastSeenXmin == 0 {
+		if state.lastSeenXmin == 0 || state.copyInProgress() {
 			resultRange.fullTable = true
 		} else {
+			state = state.widened(txids.xmax)
+			resultRange.fullTable, err = job.needsResync(table, state, txids)
+			if err != nil {
+				return resultRange, err
+			}
 			resultRange.startXmin = state.lastSeenXmin + 1
 		}
 	}
 
-	var whereClause string
-	if len(where) > 0 {
-		whereClause = "where " + where
+	if !resultRange.fullTable {
+		targetLength, err := job.targetSink().tableLength(job.ctx, job.cfg.targetTable(table), job.targetWhere(where))
+		if err != nil {
+			return resultRange, err
+		}
+
+		if float64(targetLength) < float64(source.length)*job.cfg.FullCopyThreshold {
+			resultRange.fullTable = true
+		}
 	}
-	q := fmt.Sprintf("select count(*), max(xmin::text::bigint) from %s %s", table, whereClause)
-	row := job.source.QueryRow(job.ctx, q)
 
-	var sourceLength uint64
-	err := row.Scan(&sourceLength, &resultRange.endXmin)
+	return resultRange, nil
+}
+
+// needsResync checks if source transaction ids have wrapped or been frozen in ways
+// that prevent the table from being incrementally synced from the stored state.
+func (job *Job) needsResync(table string, state tableState, txids sourceTxids) (bool, error) {
+	reason, err := resyncReason(state, txids, func() (uint64, error) {
+		return getFrozenXid(job.ctx, job.source, table, txids.xmax)
+	})
 	if err != nil {
-		return resultRange, err
+		return false, err
+	}
+	if reason != "" {
+		logger.Info.Printf("%s for table %q, marking for re-sync", reason, table)
+		return true, nil
 	}
 
-	if !resultRange.fullTable {
-		targetLength, err := getTableLength(job.ctx, job.target, table, where)
+	if !state.epochAware() {
+		logger.Info.Printf("No frozen row tracking for table %q yet, assuming no unsynced rows were frozen", table)
+	}
+	return false, nil
+}
+
+// resyncReason returns why the table cannot be incrementally synced from the
+// (widened) stored state, or an empty string. "frozenXid" returns the epoch-aware
+// relfrozenxid of the source table, and is only called for epoch-aware states.
+func resyncReason(state tableState, txids sourceTxids, frozenXid func() (uint64, error)) (string, error) {
+	if state.lastSeenXmin >= txids.xmax || state.checkedXid > txids.xmax {
+		return "Source transaction ids are behind the stored state", nil
+	}
+
+	if !state.epochAware() {
+		return "", nil
+	}
+
+	frozen, err := frozenXid()
+	if err != nil {
+		return "", err
+	}
+	if frozen > state.checkedXid {
+		return "Unsynced rows might have been frozen", nil
+	}
+
+	return "", nil
+}
+
+// targetRange is the update range of a single target, applied in the background
+// from chunks of rows read from the source
+type targetRange struct {
+	job         *Job
+	updateRange updateRange
+	chunks      chan updateChunk
+	done        chan struct{}
+	err         error
+	rowsApplied uint32
+	// Set when the target could not keep up with the source, and was left behind
+	lagging bool
+	// All rows of transactions up to this xmin have been applied
+	appliedXmin uint64
+}
+
+// updateChunk is a chunk of updated rows read from the source
+type updateChunk struct {
+	columns []string
+	rows    [][]interface{}
+	xmins   []uint64
+	// All rows of transactions up to this xmin have been read
+	lastCompleteXmin uint64
+}
+
+// syncUpdates syncs added and updated rows to all targets. Targets needing a full copy
+// are copied separately, the others are updated from a shared read of the source.
+// Returns the names of the fully copied targets.
+func (job *Job) syncUpdates(table string, primaryKeys []string, where string) (map[string]bool, error) {
+	logger.Info.Printf("Fetching update range for table %s", table)
+	source, err := job.getSourceRange(table, where)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get update range: %w", err)
+	}
+
+	copied := make(map[string]bool)
+	ranges := make(map[string]*targetRange)
+	err = job.eachTarget(func(target *Job) error {
+		updateRange, err := target.getUpdateRange(table, where, source)
 		if err != nil {
-			return resultRange, err
+			return fmt.Errorf("failed to get update range: %w", err)
+		}
+		if updateRange.fullTable {
+			logger.Info.Printf("Performing full table sync for stale / empty table")
+			copied[target.targetName] = true
+			return target.syncFullTable(table, primaryKeys, where, updateRange)
 		}
+		ranges[target.targetName] = &targetRange{job: target, updateRange: updateRange}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		if float64(targetLength) < float64(sourceLength)*job.cfg.FullCopyThreshold {
-			resultRange.fullTable = true
+	err = job.updateTableRanges(table, primaryKeys, ranges, where)
+	if err != nil {
+		return nil, err
+	}
+
+	err = job.eachTarget(func(target *Job) error {
+		targetRange, found := ranges[target.targetName]
+		if !found {
+			return nil
+		}
+		target.updatedRows += targetRange.rowsApplied
+		if targetRange.err != nil {
+			return targetRange.err
+		}
+		lastSeenXmin := targetRange.updateRange.startXmin - 1
+		if !targetRange.updateRange.empty() {
+			lastSeenXmin = targetRange.updateRange.endXmin
+		}
+		return target.setTableCheckedState(table, lastSeenXmin, source.txids.xmin)
+	})
+	return copied, err
+}
+
+// updateTableRanges applies the updated rows of all target ranges. Targets left behind
+// by a shared read are caught up by another read, starting from their own state.
+// Each read keeps at least the fastest target, so all targets are eventually updated.
+func (job *Job) updateTableRanges(table string, primaryKeys []string, ranges map[string]*targetRange, where string) error {
+	var pending []*targetRange
+	for _, targetRange := range ranges {
+		if !targetRange.updateRange.empty() {
+			pending = append(pending, targetRange)
 		}
 	}
 
-	return resultRange, nil
+	for len(pending) > 0 {
+		err := job.readTargetRanges(table, primaryKeys, pending, where)
+		if err != nil {
+			return err
+		}
+
+		var lagging []*targetRange
+		for _, targetRange := range pending {
+			if !targetRange.lagging || targetRange.err != nil {
+				continue
+			}
+			targetRange.lagging = false
+			targetRange.updateRange.startXmin = targetRange.appliedXmin + 1
+			if !targetRange.updateRange.empty() {
+				logger.Info.Printf("Catching up target %s for table %s", targetRange.job.targetName, table)
+				lagging = append(lagging, targetRange)
+			}
+		}
+		pending = lagging
+	}
+	return nil
 }
 
-func (job *Job) updateTableRange(table string, primaryKeys []string, updRange updateRange, where string) error {
+// readTargetRanges reads the updated rows of the target ranges from the source once,
+// starting at the earliest range. The rows are applied to each target in the background.
+func (job *Job) readTargetRanges(table string, primaryKeys []string, ranges []*targetRange, where string) error {
+	var active []*targetRange
+	var updRange updateRange
+	for _, targetRange := range ranges {
+		if len(active) == 0 || targetRange.updateRange.startXmin < updRange.startXmin {
+			updRange = targetRange.updateRange
+		}
+		active = append(active, targetRange)
+	}
+	if len(active) == 0 {
+		return nil
+	}
+
+	logger.Info.Printf("Updating table %s", table)
 	logger.Debug.Printf("Updating table %s from %v to %v", table, updRange.startXmin, updRange.endXmin)
-	throttle := newThrottle("updates", job.cfg.ThrottlePercentage)
-	xmin := updRange.startXmin
-	offset := 0
+	throttle := newThrottle("updates", job.throttleBudget, job.cfg.ThrottlePercentage)
+
+	// A single target is always waited for
+	backlog := 0
+	if len(active) > 1 {
+		backlog = targetChunkBacklog
+	}
+	started := active
+	for _, targetRange := range started {
+		targetRange.chunks = make(chan updateChunk, backlog)
+		targetRange.done = make(chan struct{})
+		targetRange.appliedXmin = targetRange.updateRange.startXmin - 1
+		go targetRange.apply(table, primaryKeys)
+	}
+	defer func() {
+		for _, targetRange := range started {
+			if !targetRange.lagging {
+				close(targetRange.chunks)
+			}
+		}
+		for _, targetRange := range started {
+			<-targetRange.done
+		}
+	}()
 
 	var whereClause string
 	if len(where) > 0 {
@@ -82,103 +310,217 @@ func (job *Job) updateTableRange(table string, primaryKeys []string, updRange up
 	}
 
 	orderClause := strings.Join(keySorting, ", ")
+	xidExpression := widenedXminExpression(4)
+
+	// The last read row is used as cursor, starting right before the range.
+	// Postgres cannot index xmin, so each chunk is still a sequential scan of the
+	// table, with a sort of the remaining rows in the range. The cursor only avoids
+	// the growing cost of skipping already read rows with an offset.
+	lastXmin := updRange.startXmin - 1
+	var lastKey PrimaryKeySet
 
-	for xmin <= updRange.endXmin {
+	for {
 		throttle.start()
+
+		queryParameters := []interface{}{updRange.startXmin, job.cfg.UpdateChunkSize, updRange.endXmin, updRange.txids.xmax}
+		var cursorClause string
+		if lastKey != nil {
+			cursorColumns := append([]string{xidExpression}, primaryKeys...)
+			cursorClause = "and " + tupleComparison(cursorColumns, ">", len(queryParameters)+1)
+			queryParameters = append(queryParameters, lastXmin)
+			queryParameters = append(queryParameters, lastKey.Values()...)
+		}
+
 		q := fmt.Sprintf(`--sql 
 		select
-			xmin, *
+			%[4]s as sslr_xid, %[7]s
 		from
 			%[1]s
 		where
-			xmin::text::bigint >= $1
+			%[5]s
+			and %[4]s between $1 and $3
+			%[6]s
 			%[3]s
 		order by
-			xmin::text::bigint asc,
+			sslr_xid asc,
 			%[2]s
-		offset
-			$2
 		limit
-			$3
-		;`, table, orderClause, whereClause)
+			$2
+		;`, table, orderClause, whereClause, xidExpression, normalXminCondition, cursorClause, job.selectList(table))
 
 		logger.Info.Printf("Reading from source")
 
-		rows, err := job.source.Query(job.ctx, q, xmin, offset, job.cfg.UpdateChunkSize)
+		rows, err := job.source.Query(job.ctx, q, queryParameters...)
 		if err != nil {
 			return fmt.Errorf("query execution failure: %w", err)
 		}
-		rowsErr := rows.Err()
-		if rowsErr != nil && rowsErr != pgx.ErrNoRows {
-			return fmt.Errorf("row failure: %w", rowsErr)
-		}
-		defer rows.Close()
 
 		var columnNames []string
 		columns := rows.FieldDescriptions()
 		if len(columns) < 2 {
+			rows.Close()
 			return errors.New("unexpected number of columns")
 		}
 		for _, column := range columns[1:] {
 			columnNames = append(columnNames, string(column.Name))
 		}
+		keyIndices := keyColumnIndices(primaryKeys, columnNames)
+		transformer := job.rowTransformer(table, columnNames)
 
-		var rowValues [][]interface{}
-		lastCompleteXmin := uint64(0)
+		chunk := updateChunk{columns: job.targetColumns(columnNames)}
+		var bytesRead uint64
 
 		for rows.Next() {
 			values, err := rows.Values()
 			if err != nil {
+				rows.Close()
 				return err
 			}
+			bytesRead += rawRowSize(rows)
 
-			lastUpdatedXmin := uint64(values[0].(uint32))
-			if lastUpdatedXmin == xmin {
-				offset++
-			} else {
-				lastCompleteXmin = xmin
-				xmin = lastUpdatedXmin
-				offset = 1
+			rowXmin := uint64(values[0].(int64))
+			if rowXmin != lastXmin {
+				// All rows of earlier transactions have been read
+				chunk.lastCompleteXmin = rowXmin - 1
+			}
+			lastXmin = rowXmin
+			lastKey = make(PrimaryKeySet, len(keyIndices))
+			for i, keyIndex := range keyIndices {
+				lastKey[i].value = values[1+keyIndex]
 			}
-			rowValues = append(rowValues, values[1:])
+			transformer.apply(values[1:])
+			chunk.rows = append(chunk.rows, job.targetRow(values[1:]))
+			chunk.xmins = append(chunk.xmins, rowXmin)
+		}
+		rows.Close()
+		rowsErr := rows.Err()
+		if rowsErr != nil && rowsErr != pgx.ErrNoRows {
+			return fmt.Errorf("row failure: %w", rowsErr)
 		}
+		throttle.consume(uint64(len(chunk.rows)), bytesRead)
 		throttle.end()
 
-		if len(rowValues) > 0 {
-			logger.Info.Printf("Writing %d rows to target", len(rowValues))
-			err = applyUpdates(job.ctx, job.target, table, primaryKeys, columnNames, rowValues)
+		done := len(chunk.rows) < int(job.cfg.UpdateChunkSize)
+		if done {
+			chunk.lastCompleteXmin = updRange.endXmin
+		}
+
+		active = sendChunk(active, chunk, table)
+		if done || len(active) == 0 {
+			break
+		}
+		throttle.wait()
+
+		err = job.pauseForBlackouts(table)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendChunk queues a chunk for all active target ranges, and returns the ones still active.
+// Targets that have failed are dropped. When no target has room for the chunk, it waits for
+// the first one to make room. Targets with a full backlog are left behind, to be caught up later.
+func sendChunk(active []*targetRange, chunk updateChunk, table string) []*targetRange {
+	var accepted []*targetRange
+	var full []*targetRange
+	for _, targetRange := range active {
+		select {
+		case <-targetRange.done:
+			continue
+		default:
+		}
+
+		select {
+		case targetRange.chunks <- chunk:
+			accepted = append(accepted, targetRange)
+		default:
+			full = append(full, targetRange)
+		}
+	}
+
+	for len(accepted) == 0 && len(full) > 0 {
+		var cases []reflect.SelectCase
+		for _, targetRange := range full {
+			cases = append(cases,
+				reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(targetRange.chunks), Send: reflect.ValueOf(chunk)},
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(targetRange.done)},
+			)
+		}
+		chosen, _, _ := reflect.Select(cases)
+		targetRange := full[chosen/2]
+		full = append(full[:chosen/2], full[chosen/2+1:]...)
+		if chosen%2 == 0 {
+			accepted = append(accepted, targetRange)
+		}
+	}
+
+	for _, targetRange := range full {
+		logger.Warning.Printf("Target %s cannot keep up, catching it up later for table %s", targetRange.job.targetName, table)
+		targetRange.lagging = true
+		close(targetRange.chunks)
+	}
+	return accepted
+}
+
+// apply applies queued chunks to the target, skipping rows before the start of the target range.
+// Stops at the first error.
+func (r *targetRange) apply(table string, primaryKeys []string) {
+	defer close(r.done)
+	for chunk := range r.chunks {
+		var rows [][]interface{}
+		var xmins []uint64
+		for i, row := range chunk.rows {
+			if chunk.xmins[i] >= r.updateRange.startXmin {
+				rows = append(rows, row)
+				xmins = append(xmins, chunk.xmins[i])
+			}
+		}
+
+		if len(rows) > 0 {
+			logger.Info.Printf("Writing %d rows to target", len(rows))
+			err := r.job.applyRows(table, primaryKeys, chunk.columns, rows, xmins)
 			if err != nil {
-				return fmt.Errorf("failed to apply updates: %w", err)
+				r.err = fmt.Errorf("failed to apply updates: %w", err)
+				return
 			}
-			job.updatedRows += uint32(len(rowValues))
-			throttle.wait()
-		} else {
-			lastCompleteXmin = xmin
-			xmin++
+			r.rowsApplied += uint32(len(rows))
 		}
 
-		if lastCompleteXmin != 0 {
-			err = job.setTableXminState(table, lastCompleteXmin)
+		if chunk.lastCompleteXmin >= r.updateRange.startXmin {
+			err := r.job.setTableXminState(table, chunk.lastCompleteXmin)
 			if err != nil {
-				return err
+				r.err = err
+				return
 			}
+			r.appliedXmin = chunk.lastCompleteXmin
 		}
 	}
-
-	return nil
 }
 
-func applyUpdates(ctx context.Context, target *pgx.Conn, table string, primaryKeys []string, columns []string, values [][]interface{}) error {
-	tx, err := target.Begin(ctx)
+// applyRows applies updated rows to the target, using the configured apply strategy
+func (job *Job) applyRows(table string, primaryKeys []string, columns []string, rows [][]interface{}, xmins []uint64) error {
+	keyTypes, err := job.getPrimaryKeyTypes(table, primaryKeys)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if tx != nil {
-			tx.Rollback(ctx)
-		}
-	}()
+	keyTypes = job.targetKeyTypes(keyTypes)
+	return job.targetSink().applyChunk(job.ctx, job.cfg.targetTable(table), job.targetKeys(primaryKeys), keyTypes, columns, rows, xmins, job.cfg.ApplyStrategy)
+}
 
+// rawRowSize returns the size in bytes of the current row as received from the database
+func rawRowSize(rows pgx.Rows) uint64 {
+	var size uint64
+	for _, value := range rows.RawValues() {
+		size += uint64(len(value))
+	}
+	return size
+}
+
+// keyColumnIndices returns the positions of the primary keys in a list of column names
+func keyColumnIndices(primaryKeys []string, columns []string) []int {
 	var primaryColumnIndices = make([]int, len(primaryKeys))
 
 	for i, primaryKey := range primaryKeys {
@@ -190,6 +532,22 @@ func applyUpdates(ctx context.Context, target *pgx.Conn, table string, primaryKe
 		}
 	}
 
+	return primaryColumnIndices
+}
+
+func applyUpdates(ctx context.Context, target dbConn, table string, primaryKeys []string, keyTypes []columnType, columns []string, values [][]interface{}) error {
+	tx, err := target.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	primaryColumnIndices := keyColumnIndices(primaryKeys, columns)
+
 	var keys PrimaryKeySetSlice
 	for _, row := range values {
 		var rowKeys PrimaryKeySet
@@ -199,7 +557,7 @@ func applyUpdates(ctx context.Context, target *pgx.Conn, table string, primaryKe
 		keys = append(keys, rowKeys)
 	}
 
-	err = deleteRows(ctx, tx, table, primaryKeys, keys)
+	err = deleteRows(ctx, tx, table, primaryKeys, keyTypes, keys)
 	if err != nil {
 		return err
 	}
@@ -221,22 +579,120 @@ func applyUpdates(ctx context.Context, target *pgx.Conn, table string, primaryKe
 	return nil
 }
 
-func deleteRows(ctx context.Context, target pgx.Tx, table string, primaryKeys []string, keys PrimaryKeySetSlice) error {
+// applyUpserts copies rows to a temporary staging table, and merges them into the target
+// table. Rows that are unchanged in the target are not written.
+func applyUpserts(ctx context.Context, target dbConn, table string, primaryKeys []string, columns []string, values [][]interface{}) error {
+	tx, err := target.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	// The staging table is created from the current target table for each chunk.
+	// It is dropped explicitly, since an atomic apply transaction commits much later.
+	staging := stagingTableName(table)
+	_, err = tx.Exec(ctx, fmt.Sprintf(`--sql
+	create temporary table %[1]s (like %[2]s including defaults) on commit drop
+	;`, staging, table))
+	if err != nil {
+		return fmt.Errorf("failed to create staging table: %w", err)
+	}
+
+	rowsCopied, err := tx.CopyFrom(ctx, pgx.Identifier{staging}, columns, pgx.CopyFromRows(values))
+	if err != nil {
+		return err
+	}
+	if rowsCopied != int64(len(values)) {
+		return fmt.Errorf("unexpected row count, %d != %d", rowsCopied, len(values))
+	}
+
+	isKey := make(map[string]bool)
+	for _, key := range primaryKeys {
+		isKey[key] = true
+	}
+	var columnList []string
+	var updates []string
+	for _, column := range columns {
+		quoted := pgx.Identifier{column}.Sanitize()
+		columnList = append(columnList, quoted)
+		if !isKey[column] {
+			updates = append(updates, fmt.Sprintf("%[1]s = excluded.%[1]s", quoted))
+		}
+	}
+
+	conflictAction := "do nothing"
+	if len(updates) > 0 {
+		// Rows are compared as text, since not all types have equality operators
+		conflictAction = fmt.Sprintf(`do update set
+			%s
+		where
+			row(sslr_target.*)::text is distinct from row(excluded.*)::text`, strings.Join(updates, ", "))
+	}
+
+	q := fmt.Sprintf(`--sql
+	insert into %[1]s as sslr_target (%[2]s)
+	select %[2]s from %[3]s
+	on conflict (%[4]s) %[5]s
+	;`, table, strings.Join(columnList, ", "), staging, strings.Join(primaryKeys, ", "), conflictAction)
+
+	tag, err := tx.Exec(ctx, q)
+	if err != nil {
+		return err
+	}
+	logger.Debug.Printf("Upserted %d of %d rows", tag.RowsAffected(), len(values))
+
+	_, err = tx.Exec(ctx, fmt.Sprintf("drop table %s", staging))
+	if err != nil {
+		return fmt.Errorf("failed to drop staging table: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	tx = nil
+	return nil
+}
+
+// stagingTableName returns the name of the temporary staging table for a table.
+// The name is derived from a hash, to stay unique within the identifier length limit.
+func stagingTableName(table string) string {
+	return fmt.Sprintf("__sslr_staging_%x", md5.Sum([]byte(table)))
+}
+
+// deleteRows deletes rows by primary key. The keys are passed as text arrays,
+// which are cast to the key column types on the server.
+func deleteRows(ctx context.Context, target pgx.Tx, table string, primaryKeys []string, keyTypes []columnType, keys PrimaryKeySetSlice) error {
 	if len(keys) == 0 {
 		return nil
 	}
 
+	if len(keyTypes) != len(primaryKeys) {
+		return errors.New("Key type length mismatch")
+	}
+
+	connInfo := target.Conn().ConnInfo()
 	keyList := strings.Join(primaryKeys, ", ")
-	keyValues := keys.Transposed()
-	var parameternames = make([]string, len(keyValues))
-	for i, column := range keyValues {
-		rows := column.([]interface{})
-		first := rows[0]
-		keyType := "int"
-		if _, ok := first.(string); ok {
-			keyType = "varchar"
+	keyValues := make([]interface{}, len(primaryKeys))
+	var parameternames = make([]string, len(primaryKeys))
+	for i, keyType := range keyTypes {
+		if keyType.name == "" {
+			return fmt.Errorf("unknown type of key %q", primaryKeys[i])
+		}
+		column := make([]string, len(keys))
+		for j, row := range keys {
+			text, err := row[i].Text(connInfo, keyType.oid)
+			if err != nil {
+				return fmt.Errorf("failed to convert key %q: %w", primaryKeys[i], err)
+			}
+			column[j] = text
 		}
-		parameternames[i] = fmt.Sprintf("$%d::%s[]", i+1, keyType)
+		keyValues[i] = column
+		parameternames[i] = fmt.Sprintf("$%d::text[]::%s[]", i+1, keyType.name)
 	}
 	d := fmt.Sprintf(`--sql
 	delete from %[1]s
@@ -253,7 +709,7 @@ func deleteRows(ctx context.Context, target pgx.Tx, table string, primaryKeys []
 	return nil
 }
 
-func getTableLength(ctx context.Context, conn *pgx.Conn, table string, where string) (uint64, error) {
+func getTableLength(ctx context.Context, conn dbConn, table string, where string) (uint64, error) {
 	var whereClause string
 	if len(where) > 0 {
 		whereClause = "where " + where
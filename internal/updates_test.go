@@ -0,0 +1,101 @@
+package sslr
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestStagingTableName(t *testing.T) {
+	long := "public." + strings.Repeat("a", 60)
+	first := stagingTableName(long + "1")
+	second := stagingTableName(long + "2")
+	if len(first) > maxIdentifierLength {
+		t.Errorf("staging table name %q is too long", first)
+	}
+	if first == second {
+		t.Errorf("staging table names collide: %q", first)
+	}
+}
+
+func TestApplyUpsertsAfterSchemaChange(t *testing.T) {
+	conn := testConnection(t)
+	ctx := context.Background()
+
+	_, err := conn.Exec(ctx, "create temporary table upsert_test (id int primary key, name text)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = applyUpserts(ctx, conn, "upsert_test", []string{"id"}, []string{"id", "name"}, [][]interface{}{
+		{int32(1), "one"}, {int32(2), "two"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A staging table left from the first chunk would lack the new column
+	_, err = conn.Exec(ctx, "alter table upsert_test add column size int")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = applyUpserts(ctx, conn, "upsert_test", []string{"id"}, []string{"id", "name", "size"}, [][]interface{}{
+		{int32(2), "two", int32(2)}, {int32(3), "three", int32(3)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count, sizes int
+	err = conn.QueryRow(ctx, "select count(*), coalesce(sum(size), 0) from upsert_test").Scan(&count, &sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || sizes != 5 {
+		t.Errorf("got %v rows with total size %v, expected 3 rows with total size 5", count, sizes)
+	}
+}
+
+func TestSendChunkLeavesSlowTargetBehind(t *testing.T) {
+	fast := &targetRange{job: &Job{targetName: "fast"}, chunks: make(chan updateChunk, 1), done: make(chan struct{})}
+	slow := &targetRange{job: &Job{targetName: "slow"}, chunks: make(chan updateChunk, 1), done: make(chan struct{})}
+	slow.chunks <- updateChunk{}
+
+	active := sendChunk([]*targetRange{slow, fast}, updateChunk{}, "table")
+	if len(active) != 1 || active[0] != fast {
+		t.Fatalf("expected only the fast target to stay active, got %v", active)
+	}
+	if !slow.lagging || fast.lagging {
+		t.Errorf("expected only the slow target to lag")
+	}
+}
+
+func TestSendChunkWaitsForFirstTarget(t *testing.T) {
+	first := &targetRange{job: &Job{targetName: "first"}, chunks: make(chan updateChunk, 1), done: make(chan struct{})}
+	second := &targetRange{job: &Job{targetName: "second"}, chunks: make(chan updateChunk, 1), done: make(chan struct{})}
+	first.chunks <- updateChunk{}
+	second.chunks <- updateChunk{}
+
+	go func() {
+		<-second.chunks
+	}()
+	active := sendChunk([]*targetRange{first, second}, updateChunk{}, "table")
+	if len(active) != 1 || active[0] != second {
+		t.Fatalf("expected the target making room to stay active, got %v", active)
+	}
+	if !first.lagging {
+		t.Errorf("expected the full target to lag")
+	}
+}
+
+func TestSendChunkDropsFailedTarget(t *testing.T) {
+	failed := &targetRange{job: &Job{targetName: "failed"}, chunks: make(chan updateChunk), done: make(chan struct{})}
+	close(failed.done)
+
+	active := sendChunk([]*targetRange{failed}, updateChunk{}, "table")
+	if len(active) != 0 {
+		t.Fatalf("expected no active targets, got %v", active)
+	}
+	if failed.lagging {
+		t.Errorf("expected the failed target not to lag")
+	}
+}
@@ -0,0 +1,91 @@
+package sslr
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Row xmin values are 32-bit transaction ids that wrap around, and frozen rows
+// report the special id 2. To be able to track changes across wraparounds,
+// SSLR converts row xmin values to epoch-aware 64-bit transaction ids, using
+// the current source transaction id as reference.
+
+const (
+	xidEpochSize = uint64(1) << 32
+	// Transaction ids below this are special (invalid, bootstrap and frozen)
+	firstNormalXid = 3
+)
+
+// sourceTxids holds epoch-aware transaction ids from a source snapshot
+type sourceTxids struct {
+	// All transactions before this are finished
+	xmin uint64
+	// All transactions from this on are not yet started
+	xmax uint64
+}
+
+func getSourceTxids(ctx context.Context, conn *pgx.Conn) (sourceTxids, error) {
+	var result sourceTxids
+
+	row := conn.QueryRow(ctx, `--sql
+	select
+		txid_snapshot_xmin(s), txid_snapshot_xmax(s)
+	from
+		txid_current_snapshot() as s
+	;`)
+	err := row.Scan(&result.xmin, &result.xmax)
+	if err != nil {
+		return result, fmt.Errorf("failed to get source transaction ids: %w", err)
+	}
+	return result, nil
+}
+
+// widenXid converts a 32-bit transaction id to the most recent epoch-aware
+// transaction id with the same low bits, not later than the reference id.
+func widenXid(xid uint32, reference uint64) uint64 {
+	wide := reference&^(xidEpochSize-1) | uint64(xid)
+	if wide > reference && wide >= xidEpochSize {
+		wide -= xidEpochSize
+	}
+	return wide
+}
+
+// widenedXminExpression returns an SQL expression performing the same conversion
+// as widenXid on the row xmin, using query parameter number "reference" as reference id.
+func widenedXminExpression(reference int) string {
+	return fmt.Sprintf(`(
+		(($%[1]d::bigint >> 32) << 32) + xmin::text::bigint -
+		case
+			when xmin::text::bigint > ($%[1]d::bigint & 4294967295) and $%[1]d::bigint >= 4294967296 then 4294967296
+			else 0
+		end
+	)`, reference)
+}
+
+// normalXminCondition filters out rows with special xmin values, like frozen rows.
+var normalXminCondition = fmt.Sprintf("xmin::text::bigint >= %d", firstNormalXid)
+
+// getFrozenXid returns the epoch-aware id of the oldest unfrozen transaction
+// in the given source table, or zero if not known.
+func getFrozenXid(ctx context.Context, conn dbConn, table string, reference uint64) (uint64, error) {
+	row := conn.QueryRow(ctx, `--sql
+	select
+		relfrozenxid::text::bigint
+	from
+		pg_class
+	where
+		oid = $1::regclass
+	;`, table)
+
+	var frozenXid uint32
+	err := row.Scan(&frozenXid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get frozen transaction id: %w", err)
+	}
+	if frozenXid < firstNormalXid {
+		return 0, nil
+	}
+	return widenXid(frozenXid, reference), nil
+}
@@ -0,0 +1,181 @@
+package sslr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+const epoch = xidEpochSize
+
+func TestWidenXid(t *testing.T) {
+	tests := []struct {
+		xid       uint32
+		reference uint64
+		expected  uint64
+	}{
+		{xid: 100, reference: 1000, expected: 100},
+		{xid: 1000, reference: 1000, expected: 1000},
+		// No earlier epoch to move to in epoch 0
+		{xid: 2000, reference: 1000, expected: 2000},
+		{xid: 0, reference: epoch, expected: epoch},
+		{xid: 5, reference: epoch, expected: 5},
+		{xid: 50, reference: epoch + 100, expected: epoch + 50},
+		// Transactions before the wraparound belong to the previous epoch
+		{xid: 4294967000, reference: epoch + 100, expected: 4294967000},
+		{xid: 4294967295, reference: epoch + 100, expected: epoch - 1},
+		{xid: 3, reference: 5*epoch + 3, expected: 5*epoch + 3},
+		{xid: 4, reference: 5*epoch + 3, expected: 4*epoch + 4},
+	}
+
+	for _, test := range tests {
+		actual := widenXid(test.xid, test.reference)
+		if actual != test.expected {
+			t.Errorf("widenXid(%v, %v) = %v, expected %v", test.xid, test.reference, actual, test.expected)
+		}
+	}
+}
+
+func TestWidenedXminExpression(t *testing.T) {
+	conn := testConnection(t)
+	ctx := context.Background()
+
+	_, err := conn.Exec(ctx, "create temporary table xid_test (id int)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(ctx, "insert into xid_test values (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var xmin uint32
+	err = conn.QueryRow(ctx, "select xmin::text::bigint from xid_test").Scan(&xmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	references := []uint64{
+		uint64(xmin), uint64(xmin) - 1, uint64(xmin) + 1,
+		epoch + uint64(xmin), epoch + uint64(xmin) - 1, 7*epoch + 1,
+	}
+	for _, reference := range references {
+		var actual int64
+		q := fmt.Sprintf("select %s from xid_test", widenedXminExpression(1))
+		err = conn.QueryRow(ctx, q, reference).Scan(&actual)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := widenXid(xmin, reference)
+		if actual != int64(expected) {
+			t.Errorf("xmin %v with reference %v widened to %v in SQL, expected %v", xmin, reference, actual, expected)
+		}
+	}
+}
+
+func TestResyncReason(t *testing.T) {
+	errFrozen := errors.New("frozen lookup failed")
+	frozenAt := func(xid uint64) func() (uint64, error) {
+		return func() (uint64, error) {
+			return xid, nil
+		}
+	}
+	notCalled := func() (uint64, error) {
+		return 0, errors.New("frozen xid looked up for a legacy state")
+	}
+
+	tests := []struct {
+		name      string
+		state     tableState
+		txids     sourceTxids
+		frozenXid func() (uint64, error)
+		resync    bool
+		err       error
+	}{
+		{
+			name:      "legacy state before wraparound",
+			state:     tableState{lastSeenXmin: 4294967000},
+			txids:     sourceTxids{xmin: 4294967100, xmax: 4294967200},
+			frozenXid: notCalled,
+		},
+		{
+			name:      "legacy state across wraparound",
+			state:     tableState{lastSeenXmin: 4294967000},
+			txids:     sourceTxids{xmin: epoch + 500, xmax: epoch + 1000},
+			frozenXid: notCalled,
+		},
+		{
+			name:      "legacy state ahead of source",
+			state:     tableState{lastSeenXmin: 5000},
+			txids:     sourceTxids{xmin: 3000, xmax: 4000},
+			frozenXid: notCalled,
+			resync:    true,
+		},
+		{
+			name:      "epoch-aware state",
+			state:     tableState{lastSeenXmin: epoch + 10, checkedXid: epoch + 20},
+			txids:     sourceTxids{xmin: epoch + 90, xmax: epoch + 100},
+			frozenXid: frozenAt(epoch + 15),
+		},
+		{
+			name:      "unsynced rows frozen",
+			state:     tableState{lastSeenXmin: epoch + 10, checkedXid: epoch + 20},
+			txids:     sourceTxids{xmin: epoch + 90, xmax: epoch + 100},
+			frozenXid: frozenAt(epoch + 30),
+			resync:    true,
+		},
+		{
+			name:      "frozen before epoch",
+			state:     tableState{lastSeenXmin: epoch + 10, checkedXid: epoch + 20},
+			txids:     sourceTxids{xmin: epoch + 90, xmax: epoch + 100},
+			frozenXid: frozenAt(4294967000),
+		},
+		{
+			name:      "source reset behind checked xid",
+			state:     tableState{lastSeenXmin: 10, checkedXid: 2 * epoch},
+			txids:     sourceTxids{xmin: 90, xmax: 100},
+			frozenXid: frozenAt(0),
+			resync:    true,
+		},
+		{
+			name:  "frozen lookup failing",
+			state: tableState{lastSeenXmin: epoch + 10, checkedXid: epoch + 20},
+			txids: sourceTxids{xmin: epoch + 90, xmax: epoch + 100},
+			frozenXid: func() (uint64, error) {
+				return 0, errFrozen
+			},
+			err: errFrozen,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := test.state.widened(test.txids.xmax)
+			reason, err := resyncReason(state, test.txids, test.frozenXid)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if (reason != "") != test.resync {
+				t.Errorf("expected re-sync %v, got reason %q", test.resync, reason)
+			}
+		})
+	}
+}
+
+func TestWidenedLegacyState(t *testing.T) {
+	state := tableState{lastSeenXmin: 4294967000}.widened(epoch + 1000)
+	if state.lastSeenXmin != 4294967000 {
+		t.Errorf("legacy xmin before wraparound widened to %v", state.lastSeenXmin)
+	}
+
+	state = tableState{lastSeenXmin: 500}.widened(epoch + 1000)
+	if state.lastSeenXmin != epoch+500 {
+		t.Errorf("legacy xmin after wraparound widened to %v", state.lastSeenXmin)
+	}
+
+	state = tableState{lastSeenXmin: epoch + 500, checkedXid: epoch + 600}.widened(3 * epoch)
+	if state.lastSeenXmin != epoch+500 {
+		t.Errorf("epoch-aware xmin changed to %v", state.lastSeenXmin)
+	}
+}
@@ -50,8 +50,10 @@ func main() {
 			if !args.continuous {
 				break runLoop
 			}
+			nextRun := job.NextRun(time.Now())
+			logger.Info.Printf("Next run at %v", nextRun.Format(time.RFC3339))
 			select {
-			case <-time.After(config.WaitBetweenJobs):
+			case <-time.After(time.Until(nextRun)):
 				break
 			case <-ctx.Done():
 				break runLoop